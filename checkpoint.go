@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkpointEntry 检查点文件中的一行记录
+type checkpointEntry struct {
+	Fingerprint string          `json:"fingerprint"`
+	TestedAt    time.Time       `json:"tested_at"`
+	Result      *ExtendedResult `json:"result"`
+}
+
+// checkpoint 以 JSON Lines 格式记录每个已完成节点的测试结果，用于中断后恢复
+type checkpoint struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]*checkpointEntry
+}
+
+// openCheckpoint 打开检查点文件，resume 为 false 时清空已有记录
+func openCheckpoint(path string, resume bool) (*checkpoint, error) {
+	cp := &checkpoint{
+		entries: make(map[string]*checkpointEntry),
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if resume {
+		if err := cp.load(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	cp.file = file
+	return cp, nil
+}
+
+func (cp *checkpoint) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &checkpointEntry{}
+		// 进程被中断时最后一行可能不完整，跳过无法解析的行
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Result == nil {
+			continue
+		}
+		cp.entries[entry.Fingerprint] = entry
+	}
+	return scanner.Err()
+}
+
+// lookup 返回 maxAge 以内的测试结果，maxAge 为 0 表示不限制
+func (cp *checkpoint) lookup(fingerprint string, maxAge time.Duration) *ExtendedResult {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	entry, ok := cp.entries[fingerprint]
+	if !ok {
+		return nil
+	}
+	if maxAge > 0 && time.Since(entry.TestedAt) > maxAge {
+		return nil
+	}
+	return entry.Result
+}
+
+func (cp *checkpoint) record(fingerprint string, result *ExtendedResult) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	entry := &checkpointEntry{
+		Fingerprint: fingerprint,
+		TestedAt:    time.Now(),
+		Result:      result,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := cp.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	cp.entries[fingerprint] = entry
+	return nil
+}
+
+func (cp *checkpoint) Close() error {
+	return cp.file.Close()
+}
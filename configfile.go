@@ -0,0 +1,324 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/faceair/clash-speedtest/speedtester"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "CLASH_SPEEDTEST_"
+
+// fileSources 配置文件中 sources 选项定义的来源，可以为每个订阅单独设置 user-agent 和 headers
+var fileSources []speedtester.Source
+
+// repeatableFlag 可以重复设置的 flag，配置文件中的列表会逐项调用 Set
+type repeatableFlag interface {
+	flag.Value
+	repeatable()
+}
+
+// headerFlags 以 "Key: Value" 形式重复设置的请求头
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	headers := make([]string, 0, len(h))
+	for key, value := range h {
+		headers = append(headers, key+": "+value)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("invalid header %q, expected 'Key: Value'", value)
+	}
+	h[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	return nil
+}
+
+func (h headerFlags) repeatable() {}
+
+// targetFlags 以 "name=[protocol:]url" 形式重复设置的测试目标
+type targetFlags []speedtester.Target
+
+func (t *targetFlags) String() string {
+	targets := make([]string, 0, len(*t))
+	for _, target := range *t {
+		targets = append(targets, fmt.Sprintf("%s=%s:%s", target.Name, target.Protocol, target.URL))
+	}
+	return strings.Join(targets, ", ")
+}
+
+func (t *targetFlags) Set(value string) error {
+	target, err := speedtester.ParseTarget(value)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *t {
+		if existing.Name == target.Name {
+			return fmt.Errorf("duplicate target name: %s", target.Name)
+		}
+	}
+	*t = append(*t, target)
+	return nil
+}
+
+func (t *targetFlags) repeatable() {}
+
+// retryFlags 以 "phase=attempts[,backoff[,classes]]" 形式重复设置的重试策略
+type retryFlags map[string]speedtester.RetryPolicy
+
+func (r retryFlags) String() string {
+	policies := make([]string, 0, len(r))
+	for phase, policy := range r {
+		policies = append(policies, fmt.Sprintf("%s=%d,%s,%s", phase, policy.Attempts, policy.Backoff, strings.Join(policy.Retryable, "|")))
+	}
+	sort.Strings(policies)
+	return strings.Join(policies, " ")
+}
+
+func (r retryFlags) Set(value string) error {
+	phase, policy, err := speedtester.ParseRetryPolicy(value)
+	if err != nil {
+		return err
+	}
+	r[phase] = policy
+	return nil
+}
+
+func (r retryFlags) repeatable() {}
+
+// fileConfig 配置文件结构，defaults 对所有 profile 生效，profile 中的同名选项会覆盖 defaults
+//
+//	defaults:
+//	  c: { file: /run/secrets/subscription-url }
+//	  iptokens: { env: IPINFO_TOKENS }
+//	  sources:
+//	    - path: https://example.com/subscribe
+//	      user-agent: clash-verge
+//	      headers: { Authorization: { file: /run/secrets/token } }
+//	profiles:
+//	  quick:
+//	    fast: true
+//	  hk-only:
+//	    f: 'HK|港'
+//	    top-per-country: 3
+type fileConfig struct {
+	Defaults map[string]any            `yaml:"defaults"`
+	Profiles map[string]map[string]any `yaml:"profiles"`
+}
+
+// applyConfigFile 把配置文件和环境变量中的选项写入 flag
+// 优先级：命令行参数 > 环境变量 > profile > defaults > flag 默认值
+func applyConfigFile() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// 配置文件路径和 profile 决定读取哪个文件，需要在读取之前应用环境变量
+	for _, name := range []string{"config-file", "profile"} {
+		if value, ok := os.LookupEnv(envName(name)); ok && !explicit[name] {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("option %s: %w", name, err)
+			}
+		}
+	}
+
+	values := make(map[string][]string)
+	if *configFilePath != "" {
+		body, err := os.ReadFile(*configFilePath)
+		if err != nil {
+			return err
+		}
+		cfg := &fileConfig{}
+		if err := yaml.Unmarshal(body, cfg); err != nil {
+			return fmt.Errorf("parse config file: %w", err)
+		}
+
+		options := []map[string]any{cfg.Defaults}
+		if *profileName != "" {
+			profile, ok := cfg.Profiles[*profileName]
+			if !ok {
+				return fmt.Errorf("profile %s not found in %s, available: %s", *profileName, *configFilePath, strings.Join(profileNames(cfg), ", "))
+			}
+			options = append(options, profile)
+		}
+		for _, opts := range options {
+			for name, raw := range opts {
+				if name == "sources" {
+					sources, err := parseFileSources(raw)
+					if err != nil {
+						return fmt.Errorf("option sources: %w", err)
+					}
+					fileSources = sources
+					continue
+				}
+				f := flag.Lookup(name)
+				if name == "config-file" || name == "profile" || f == nil {
+					return fmt.Errorf("unknown option %q in config file", name)
+				}
+				if list, ok := raw.([]any); ok {
+					if _, ok := f.Value.(repeatableFlag); ok {
+						items := make([]string, 0, len(list))
+						for _, item := range list {
+							value, err := resolveOptionValue(item)
+							if err != nil {
+								return fmt.Errorf("option %s: %w", name, err)
+							}
+							items = append(items, value)
+						}
+						values[name] = items
+						continue
+					}
+				}
+				value, err := resolveOptionValue(raw)
+				if err != nil {
+					return fmt.Errorf("option %s: %w", name, err)
+				}
+				values[name] = []string{value}
+			}
+		}
+	} else if *profileName != "" {
+		return fmt.Errorf("-profile requires -config-file")
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = []string{value}
+		}
+	})
+
+	for name, items := range values {
+		if explicit[name] {
+			continue
+		}
+		for _, value := range items {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("option %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseFileSources 解析 sources 列表，path 和 headers 的值同样支持密钥引用
+func parseFileSources(raw any) ([]speedtester.Source, error) {
+	list, ok := raw.([]any)
+	if !ok {
+		return nil, fmt.Errorf("must be a list")
+	}
+	sources := make([]speedtester.Source, 0, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("source %d must be a map", i)
+		}
+		source := speedtester.Source{
+			Headers: make(map[string]string),
+		}
+		for key, value := range m {
+			switch key {
+			case "path", "user-agent":
+				resolved, err := resolveOptionValue(value)
+				if err != nil {
+					return nil, fmt.Errorf("source %d %s: %w", i, key, err)
+				}
+				if key == "path" {
+					source.Path = resolved
+				} else {
+					source.UserAgent = resolved
+				}
+			case "headers":
+				headers, ok := value.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("source %d headers must be a map", i)
+				}
+				for name, raw := range headers {
+					resolved, err := resolveOptionValue(raw)
+					if err != nil {
+						return nil, fmt.Errorf("source %d header %s: %w", i, name, err)
+					}
+					source.Headers[name] = resolved
+				}
+			default:
+				return nil, fmt.Errorf("source %d: unknown option %q", i, key)
+			}
+		}
+		if source.Path == "" {
+			return nil, fmt.Errorf("source %d: path is required", i)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// envName 环境变量名，例如 max-latency 对应 CLASH_SPEEDTEST_MAX_LATENCY
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func profileNames(cfg *fileConfig) []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveOptionValue 把配置文件中的值转换成 flag 可以接受的字符串
+// 支持 { file: path } 和 { env: NAME } 形式的密钥引用，避免 token 出现在命令行里
+func resolveOptionValue(raw any) (string, error) {
+	switch v := raw.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := resolveOptionValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		if len(v) != 1 {
+			return "", fmt.Errorf("secret reference must have exactly one of file or env")
+		}
+		if path, ok := v["file"].(string); ok {
+			secret, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(secret)), nil
+		}
+		if name, ok := v["env"].(string); ok {
+			secret, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			return secret, nil
+		}
+		return "", fmt.Errorf("unsupported secret reference %v", v)
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyConfigFileFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := "defaults:\n  max-latency: 300ms\nprofiles:\n  quick:\n    concurrent: 7\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	for _, name := range []string{"config-file", "profile", "max-latency", "concurrent"} {
+		previous := flag.Lookup(name).Value.String()
+		t.Cleanup(func() { flag.Set(name, previous) })
+	}
+
+	// 配置文件路径和 profile 只通过环境变量设置
+	t.Setenv("CLASH_SPEEDTEST_CONFIG_FILE", path)
+	t.Setenv("CLASH_SPEEDTEST_PROFILE", "quick")
+	if err := applyConfigFile(); err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+	if *maxLatency != 300*time.Millisecond || *concurrent != 7 {
+		t.Errorf("max-latency = %s, concurrent = %d, want 300ms from defaults and 7 from profile", *maxLatency, *concurrent)
+	}
+}
@@ -41,8 +41,67 @@ var (
 	renameNodes       = flag.Bool("rename", false, "rename nodes with IP location and speed")
 	fastMode          = flag.Bool("fast", false, "fast mode, only test latency")
 	ipTokenList       = flag.String("iptokens", "", "comma-separated list of ipinfo.io tokens")
+	sortBy            = flag.String("sort", "download", "sort results by: download, upload, latency")
+	topPerCountry     = flag.Int("top-per-country", 0, "only output the best N nodes of each country/region, 0 means no limit")
+	countryList       = flag.String("countries", "", "only output nodes of these country/region codes, use , to separate (example: -countries 'HK,JP,SG,US')")
+	configFilePath    = flag.String("config-file", "", "read options from a yaml config file, keys are the flag names")
+	profileName       = flag.String("profile", "", "use the named profile in the config file")
+	checkpointPath    = flag.String("checkpoint", "", "record every finished result to this file")
+	resumeRun         = flag.Bool("resume", false, "skip nodes already tested in the checkpoint file")
+	resumeMaxAge      = flag.Duration("resume-max-age", 24*time.Hour, "only reuse checkpoint results newer than this value, 0 means no limit")
+	fetchUserAgent    = flag.String("user-agent", "clash.meta", "user agent for fetching subscriptions")
+	fetchTimeout      = flag.Duration("fetch-timeout", 30*time.Second, "timeout for fetching subscriptions")
+	fetchRetries      = flag.Int("fetch-retries", 2, "retry times for fetching subscriptions")
+	subExpiryWarn     = flag.Duration("sub-expiry-warn", 0, "warn when a subscription expires within this duration, 0 means disabled")
+	subQuotaWarn      = flag.Float64("sub-quota-warn", 0, "warn when the remaining traffic of a subscription is less than this percent, 0 means disabled")
+	fetchProxy        = flag.String("fetch-proxy", "", "fetch subscriptions through this proxy, http(s)/socks5 url or a proxy name in local config files")
+	providerCacheDir  = flag.String("provider-cache-dir", "", "directory for caching http proxy-providers (default user cache dir)")
+	providerCacheTTL  = flag.Duration("provider-cache-ttl", 0, "reuse cached http proxy-providers newer than this value, 0 means disabled")
+	providerHealth    = flag.Bool("provider-health-check", false, "use health-check url of proxy-providers as the latency test url")
+	groupName         = flag.String("group", "", "only test the members of this proxy group, nested groups and providers are resolved")
+	downloadURL       = flag.String("download-url", "", "download this url to test download speed instead of server-url, can not be used with -target")
+	downloadRange     = flag.Bool("download-range", false, "use range requests to download only download-size bytes of download-url and get targets")
+	uploadURL         = flag.String("upload-url", "", "upload to this url to test upload speed instead of server-url, can not be used with -target")
+	uploadMethod      = flag.String("upload-method", "POST", "http method for upload-url: POST or PUT")
+	latencyCount      = flag.Int("latency-count", 6, "number of requests for each latency test")
+	latencyInterval   = flag.Duration("latency-interval", 100*time.Millisecond, "interval between latency requests")
+	latencyTimeout    = flag.Duration("latency-timeout", 0, "timeout for each latency request, 0 means max-latency")
+	latencySkipFirst  = flag.Bool("latency-skip-first", false, "send one more latency request and ignore the first one, which includes connection setup")
+	latencyStats      = flag.Bool("latency-stats", false, "show min/median/p90/p99/max latency in the result table")
+	stability         = flag.Duration("stability", 0, "run a stability test over this duration instead of the speed test (example: -stability 30m)")
+	stabilityInterval = flag.Duration("stability-interval", 10*time.Second, "interval between latency tests in stability mode")
+	stabilityTransfer = flag.Duration("stability-transfer-interval", time.Minute, "interval between small download tests in stability mode, 0 means disabled")
+	stabilityParallel = flag.Int("stability-concurrent", 0, "number of nodes tested at the same time in stability mode, 0 means all nodes")
+	webSocket         = flag.Bool("websocket", false, "test websocket upgrade time, message rtt and throughput against the echo endpoint")
+	webSocketURL      = flag.String("websocket-url", "", "websocket echo endpoint (default server-url/__ws, requires download-server)")
+	webSocketSize     = flag.Int("websocket-size", 4*1024*1024, "total message bytes for the websocket throughput test")
+	holdDuration      = flag.Duration("hold", 0, "keep a connection to the echo endpoint for this duration and report how long it survived, 0 means disabled")
+	holdIdle          = flag.Duration("hold-idle", 30*time.Second, "idle gap between payloads in the long-lived connection test")
+	holdURL           = flag.String("hold-url", "", "echo endpoint for the long-lived connection test (default server-url/__echo, requires download-server)")
+	jsonReportPath    = flag.String("json-report", "", "write the full results to this json file")
+	transport         = flag.String("transport", "h1", "http protocol for testing: h1, h2 (TLS ALPN) or h3 (QUIC over the proxy's UDP relay)")
+	bandwidthLimit    = flag.Float64("bandwidth-limit", 0, "total bandwidth cap shared by all download and upload tests(unit: MB/s), 0 means no limit")
+	targetRateLimit   = flag.Float64("target-rate-limit", 0, "max requests per second to each test target host, 0 means no limit")
+	throttleRetries   = flag.Int("throttle-retries", 2, "retry times when a test target responds 429 or 503")
+	throttleMaxWait   = flag.Duration("throttle-max-wait", 30*time.Second, "give up retrying when Retry-After is longer than this value")
+	maxTotalTraffic   = flag.Float64("max-total-traffic", 0, "total traffic budget of the run(unit: MB), download and upload sizes shrink when it runs low, 0 means no limit")
+	maxDuration       = flag.Duration("max-duration", 0, "wall-clock budget of the run, remaining nodes are not tested once it is used up, 0 means no limit")
+	tiered            = flag.Bool("tiered", false, "tiered mode: latency sweep of all nodes in parallel, a small probe download on survivors, full test on the fastest tiered-top nodes")
+	tieredProbeSize   = flag.Int("tiered-probe-size", 2*1024*1024, "probe download size in tiered mode")
+	tieredTop         = flag.Int("tiered-top", 10, "number of nodes that get the full test in tiered mode")
+	tieredConcurrent  = flag.Int("tiered-concurrent", 16, "number of nodes tested in parallel during the latency sweep in tiered mode")
+	phaseList         = flag.String("phases", "latency,download,upload,websocket,hold,hops", "ordered comma separated test phases for each node, leave one out to skip it")
+	retryPolicies     = make(retryFlags)
+	fetchHeaders      = make(headerFlags)
+	testTargets       targetFlags
 )
 
+func init() {
+	flag.Var(fetchHeaders, "header", "extra header for fetching subscriptions, can be repeated (example: -header 'Authorization: Bearer xxx')")
+	flag.Var(retryPolicies, "retry", "retry policy phase=attempts[,backoff[,classes]], phase is latency, download, upload, ip-lookup or all, classes are dial|timeout|reset|5xx (default dial|timeout|reset), can be repeated (example: -retry 'download=3,1s')")
+	flag.Var(&testTargets, "target", "named test target name=[protocol:]url, protocol is cloudflare, download-server or get, can be repeated (default is server-url)")
+}
+
 const (
 	colorRed    = "\033[31m"
 	colorGreen  = "\033[32m"
@@ -50,20 +109,49 @@ const (
 	colorReset  = "\033[0m"
 )
 
+// throttledStr 测试目标限流时代替速度和延迟显示，与测试失败区分
+const throttledStr = colorYellow + "throttled" + colorReset
+
 // ExtendedResult 扩展的结果结构，包含国家代码和IP信息
 type ExtendedResult struct {
 	speedtester.Result
-	CountryCode string
-	IP          string
+	CountryCode string `json:"country_code"`
+	IP          string `json:"ip"`
 }
 
 func main() {
 	flag.Parse()
 	log.SetLevel(log.SILENT)
 
-	if *configPathsConfig == "" {
+	if err := applyConfigFile(); err != nil {
+		log.Fatalln("load config file failed: %v", err)
+	}
+
+	if *configPathsConfig == "" && len(fileSources) == 0 {
 		log.Fatalln("please specify the configuration file")
 	}
+	if *resumeRun && *checkpointPath == "" {
+		log.Fatalln("-resume requires -checkpoint")
+	}
+	if _, ok := resultLess[*sortBy]; !ok {
+		log.Fatalln("unsupported sort metric: %s", *sortBy)
+	}
+	if len(testTargets) > 0 && (*downloadURL != "" || *uploadURL != "") {
+		log.Fatalln("-download-url and -upload-url can not be used with -target")
+	}
+	*uploadMethod = strings.ToUpper(*uploadMethod)
+	if *uploadMethod != http.MethodPost && *uploadMethod != http.MethodPut {
+		log.Fatalln("unsupported upload method: %s", *uploadMethod)
+	}
+	switch *transport {
+	case speedtester.TransportH1, speedtester.TransportH2, speedtester.TransportH3:
+	default:
+		log.Fatalln("unsupported transport: %s", *transport)
+	}
+	phases, err := speedtester.ParsePhases(*phaseList)
+	if err != nil {
+		log.Fatalln("parse phases failed: %v", err)
+	}
 
 	speedTester := speedtester.New(&speedtester.Config{
 		ConfigPaths:      *configPathsConfig,
@@ -78,12 +166,71 @@ func main() {
 		MinDownloadSpeed: *minDownloadSpeed * 1024 * 1024,
 		MinUploadSpeed:   *minUploadSpeed * 1024 * 1024,
 		FastMode:         *fastMode,
+		Sources:          fileSources,
+		FetchUserAgent:   *fetchUserAgent,
+		FetchHeaders:     fetchHeaders,
+		FetchTimeout:     *fetchTimeout,
+		FetchRetries:     *fetchRetries,
+		FetchProxy:       *fetchProxy,
+
+		ProviderCacheDir:    *providerCacheDir,
+		ProviderCacheTTL:    *providerCacheTTL,
+		ProviderHealthCheck: *providerHealth,
+
+		Group: *groupName,
+
+		LatencyCount:     *latencyCount,
+		LatencyInterval:  *latencyInterval,
+		LatencyTimeout:   *latencyTimeout,
+		LatencySkipFirst: *latencySkipFirst,
+
+		WebSocket:     *webSocket,
+		WebSocketURL:  *webSocketURL,
+		WebSocketSize: *webSocketSize,
+
+		HoldDuration: *holdDuration,
+		HoldIdle:     *holdIdle,
+		HoldURL:      *holdURL,
+
+		StabilityInterval:         *stabilityInterval,
+		StabilityTransferInterval: *stabilityTransfer,
+		StabilityConcurrent:       *stabilityParallel,
+
+		Transport:     *transport,
+		Targets:       testTargets,
+		DownloadURL:   *downloadURL,
+		DownloadRange: *downloadRange,
+		UploadURL:     *uploadURL,
+		UploadMethod:  *uploadMethod,
+
+		BandwidthLimit:  int(*bandwidthLimit * 1024 * 1024),
+		TargetRateLimit: *targetRateLimit,
+		ThrottleRetries: *throttleRetries,
+		ThrottleMaxWait: *throttleMaxWait,
+		Retry:           retryPolicies,
+
+		MaxTotalBytes: int64(*maxTotalTraffic * 1024 * 1024),
+		MaxDuration:   *maxDuration,
+
+		Tiered:           *tiered,
+		TieredProbeSize:  *tieredProbeSize,
+		TieredTopK:       *tieredTop,
+		TieredConcurrent: *tieredConcurrent,
+
+		Phases: phases,
 	})
 
 	allProxies, err := speedTester.LoadProxies(*stashCompatible)
 	if err != nil {
 		log.Fatalln("load proxies failed: %v", err)
 	}
+	printDuplicates(speedTester.Duplicates())
+	printSubscriptions(speedTester.Subscriptions())
+
+	if *stability > 0 {
+		runStability(speedTester, allProxies)
+		return
+	}
 
 	// 解析并分割字符串
 	ipTokenArray := strings.Split(*ipTokenList, ",")
@@ -93,41 +240,115 @@ func main() {
 		ipTokenArray = append(ipTokenArray, "")
 	}
 
-	bar := progressbar.Default(int64(len(allProxies)), "测试中...")
 	results := make([]*ExtendedResult, 0)
-	
-	// 使用 speedtester 的 TestProxies 方法进行测试
-	speedTester.TestProxies(allProxies, func(result *speedtester.Result) {
-		extendedResult := &ExtendedResult{
-			Result: *result,
-		}
-		
-		// 添加获取country_code和IP的逻辑
-		const epsilon = 1e-9 // 一个很小的值
-		if result.DownloadSpeed > epsilon {
-			proxy := allProxies[result.ProxyName]
-			if proxy != nil {
-				countryCode, ip, err := queryIPLocation(result.ProxyName, proxy.Proxy, *timeout*2, ipTokenArray)
-				if err == nil {
-					extendedResult.CountryCode = countryCode
-					extendedResult.IP = ip
+	pendingProxies := allProxies
+
+	var cp *checkpoint
+	if *checkpointPath != "" {
+		cp, err = openCheckpoint(*checkpointPath, *resumeRun)
+		if err != nil {
+			log.Fatalln("open checkpoint file failed: %v", err)
+		}
+		defer cp.Close()
+	}
+	if *resumeRun {
+		pendingProxies = make(map[string]*speedtester.CProxy)
+		for name, proxy := range allProxies {
+			if resumed := cp.lookup(proxy.Fingerprint(), *resumeMaxAge); resumed != nil {
+				// 节点名称和配置以本次加载的为准
+				resumed.ProxyName = name
+				resumed.ProxyConfig = proxy.Config
+				results = append(results, resumed)
+				continue
+			}
+			pendingProxies[name] = proxy
+		}
+		fmt.Printf("resumed %d nodes from checkpoint, %d nodes to test\n", len(results), len(pendingProxies))
+	}
+
+	bar := progressbar.Default(int64(len(pendingProxies)), "测试中...")
+
+	saveCheckpoint := func(result *ExtendedResult) {
+		if cp == nil {
+			return
+		}
+		if err := cp.record(allProxies[result.ProxyName].Fingerprint(), result); err != nil {
+			log.Warnln("write checkpoint failed: %v", err)
+		}
+	}
+
+	// 基于 speedtester 的事件流在进度条中显示每个节点正在进行的测试阶段和进度
+	for event := range speedTester.Stream(context.Background(), pendingProxies) {
+		switch event := event.(type) {
+		case *speedtester.PhaseStartedEvent:
+			bar.Describe(fmt.Sprintf("%s: %s", event.ProxyName, event.Phase))
+		case *speedtester.PhaseProgressEvent:
+			progress := event.Elapsed.Round(time.Second).String()
+			if event.Bytes > 0 {
+				progress = formatBytes(event.Bytes)
+			}
+			bar.Describe(fmt.Sprintf("%s: %s %s", event.ProxyName, event.Phase, progress))
+		case *speedtester.ProxyFinishedEvent:
+			result := event.Result
+			extendedResult := &ExtendedResult{
+				Result: *result,
+			}
+
+			// 添加获取country_code和IP的逻辑
+			// 快速模式下没有下载速度，按国家筛选时以延迟判断节点是否可用
+			const epsilon = 1e-9 // 一个很小的值
+			if result.DownloadSpeed > epsilon || (*fastMode && countrySelectionEnabled() && result.Latency > 0) {
+				proxy := allProxies[result.ProxyName]
+				if proxy != nil {
+					bar.Describe(fmt.Sprintf("%s: %s", result.ProxyName, speedtester.PhaseIPLookup))
+					var countryCode, ip string
+					lookupStart := time.Now()
+					attempts, err := speedTester.Retry(context.Background(), speedtester.PhaseIPLookup, func() (err error) {
+						countryCode, ip, err = queryIPLocation(result.ProxyName, proxy.Proxy, *timeout*2, ipTokenArray)
+						return err
+					})
+					extendedResult.Attempts.Record(speedtester.PhaseIPLookup, attempts)
+					speedTester.RecordUsage(speedtester.PhaseIPLookup, 0, time.Since(lookupStart))
+					if err == nil {
+						extendedResult.CountryCode = countryCode
+						extendedResult.IP = ip
+					}
 				}
 			}
+
+			saveCheckpoint(extendedResult)
+			bar.Add(1)
+			bar.Describe(result.ProxyName)
+			results = append(results, extendedResult)
 		}
-		
-		bar.Add(1)
-		bar.Describe(result.ProxyName)
-		results = append(results, extendedResult)
-	})
+	}
 
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].DownloadSpeed > results[j].DownloadSpeed
+	less := resultLess[*sortBy]
+	sort.SliceStable(results, func(i, j int) bool {
+		// 分级测试中完整测试的节点排在只下载了小文件的节点之前
+		if ri, rj := tierRank[results[i].Tier], tierRank[results[j].Tier]; *sortBy != "latency" && ri != rj {
+			return ri < rj
+		}
+		return less(results[i], results[j])
 	})
 
 	printResults(results)
+	printTargets(results)
+	printChains(results)
+	printWebSocket(results)
+	printHold(results)
+	printAttempts(results)
+	printBudget(speedTester.BudgetReport())
+
+	if *jsonReportPath != "" {
+		if err := writeJSONReport(results); err != nil {
+			log.Fatalln("write json report failed: %v", err)
+		}
+		fmt.Printf("\nsave json report to: %s\n", *jsonReportPath)
+	}
 
 	if *outputPath != "" {
-		err = saveConfig(results)
+		err = saveConfig(results, speedTester.ProxyGroups(), allProxies)
 		if err != nil {
 			log.Fatalln("save config file failed: %v", err)
 		}
@@ -152,14 +373,19 @@ func printResults(results []*ExtendedResult) {
 			"节点名称",
 			"类型",
 			"延迟",
+			"新建/复用连接",
 			"抖动",
 			"丢包率",
 			"下载速度",
 			"上传速度",
+			"负载延迟",
 			"国家代码",
 			"IP",
 		}
 	}
+	if *latencyStats {
+		headers = append(headers, "延迟分布")
+	}
 	table.SetHeader(headers)
 
 	table.SetAutoWrapText(false)
@@ -178,12 +404,17 @@ func printResults(results []*ExtendedResult) {
 	table.SetColMinWidth(2, 8)  // 类型
 	table.SetColMinWidth(3, 8)  // 延迟
 	if !*fastMode {
-		table.SetColMinWidth(4, 8)  // 抖动
-		table.SetColMinWidth(5, 8)  // 丢包率
-		table.SetColMinWidth(6, 12) // 下载速度
-		table.SetColMinWidth(7, 12) // 上传速度
-		table.SetColMinWidth(8, 8)  // 国家代码
-		table.SetColMinWidth(9, 15) // IP
+		table.SetColMinWidth(4, 12)  // 新建/复用连接
+		table.SetColMinWidth(5, 8)   // 抖动
+		table.SetColMinWidth(6, 8)   // 丢包率
+		table.SetColMinWidth(7, 12)  // 下载速度
+		table.SetColMinWidth(8, 12)  // 上传速度
+		table.SetColMinWidth(9, 12)  // 负载延迟
+		table.SetColMinWidth(10, 8)  // 国家代码
+		table.SetColMinWidth(11, 15) // IP
+	}
+	if *latencyStats {
+		table.SetColMinWidth(len(headers)-1, 24) // 延迟分布
 	}
 
 	for i, result := range results {
@@ -199,6 +430,10 @@ func printResults(results []*ExtendedResult) {
 			} else {
 				latencyStr = colorRed + latencyStr + colorReset
 			}
+		} else if result.Throttled {
+			latencyStr = throttledStr
+		} else if result.Budget == speedtester.BudgetUntested {
+			latencyStr = colorYellow + result.Budget + colorReset
 		} else {
 			latencyStr = colorRed + latencyStr + colorReset
 		}
@@ -233,9 +468,17 @@ func printResults(results []*ExtendedResult) {
 			downloadSpeedStr = colorGreen + downloadSpeedStr + colorReset
 		} else if downloadSpeed >= 5 {
 			downloadSpeedStr = colorYellow + downloadSpeedStr + colorReset
+		} else if result.Throttled && result.DownloadSpeed == 0 {
+			downloadSpeedStr = throttledStr
+		} else if result.Budget == speedtester.BudgetSkipped || result.Budget == speedtester.BudgetUntested {
+			downloadSpeedStr = colorYellow + result.Budget + colorReset
 		} else {
 			downloadSpeedStr = colorRed + downloadSpeedStr + colorReset
 		}
+		// 分级测试中没有进入完整测试的节点显示小文件的下载速度
+		if result.Tier == speedtester.TierProbe {
+			downloadSpeedStr += " (probe)"
+		}
 
 		// 上传速度颜色
 		uploadSpeed := result.UploadSpeed / (1024 * 1024)
@@ -244,32 +487,51 @@ func printResults(results []*ExtendedResult) {
 			uploadSpeedStr = colorGreen + uploadSpeedStr + colorReset
 		} else if uploadSpeed >= 2 {
 			uploadSpeedStr = colorYellow + uploadSpeedStr + colorReset
+		} else if result.Throttled && result.UploadSpeed == 0 {
+			uploadSpeedStr = throttledStr
+		} else if result.Budget == speedtester.BudgetSkipped || result.Budget == speedtester.BudgetUntested {
+			uploadSpeedStr = colorYellow + result.Budget + colorReset
 		} else {
 			uploadSpeedStr = colorRed + uploadSpeedStr + colorReset
 		}
 
+		if result.Tier == speedtester.TierProbe {
+			uploadSpeedStr = "N/A"
+		}
+
+		// 使用 h2、h3 测试时显示实际协商的协议
+		typeStr := result.ProxyType
+		if *transport != speedtester.TransportH1 && result.Protocol != "" {
+			typeStr = fmt.Sprintf("%s (%s)", result.ProxyType, result.Protocol)
+		}
+
 		var row []string
 		if *fastMode {
 			row = []string{
 				idStr,
 				result.ProxyName,
-				result.ProxyType,
+				typeStr,
 				latencyStr,
 			}
 		} else {
 			row = []string{
 				idStr,
 				result.ProxyName,
-				result.ProxyType,
+				typeStr,
 				latencyStr,
+				fmt.Sprintf("%s/%s", formatLatency(result.ColdLatency), formatLatency(result.WarmLatency)),
 				jitterStr,
 				packetLossStr,
 				downloadSpeedStr,
 				uploadSpeedStr,
+				formatBufferbloat(&result.Result),
 				result.CountryCode,
 				result.IP,
 			}
 		}
+		if *latencyStats {
+			row = append(row, formatLatencyStats(result.LatencyStats))
+		}
 
 		table.Append(row)
 	}
@@ -279,35 +541,396 @@ func printResults(results []*ExtendedResult) {
 	fmt.Println()
 }
 
-func saveConfig(results []*ExtendedResult) error {
-	proxies := make([]map[string]any, 0)
+func printSubscriptions(subscriptions []*speedtester.SubscriptionInfo) {
+	for _, info := range subscriptions {
+		parts := make([]string, 0, 3)
+		var warnings []string
+		if info.Total > 0 {
+			remaining := info.Remaining()
+			parts = append(parts, fmt.Sprintf("used %s / %s", formatBytes(info.Used()), formatBytes(info.Total)))
+			if *subQuotaWarn > 0 && float64(remaining)/float64(info.Total)*100 < *subQuotaWarn {
+				if remaining <= 0 {
+					warnings = append(warnings, "traffic exhausted")
+				} else {
+					warnings = append(warnings, fmt.Sprintf("only %s left", formatBytes(remaining)))
+				}
+			}
+		}
+		if !info.Expire.IsZero() {
+			left := time.Until(info.Expire)
+			parts = append(parts, fmt.Sprintf("expires %s", info.Expire.Format("2006-01-02")))
+			if *subExpiryWarn > 0 && left < *subExpiryWarn {
+				if left <= 0 {
+					warnings = append(warnings, "expired")
+				} else {
+					warnings = append(warnings, fmt.Sprintf("expires in %s", left.Round(time.Hour)))
+				}
+			}
+		}
+		if info.UpdateInterval > 0 {
+			parts = append(parts, fmt.Sprintf("update every %s", info.UpdateInterval))
+		}
+
+		fmt.Printf("subscription %s: %s\n", info.Source, strings.Join(parts, ", "))
+		if len(warnings) > 0 {
+			fmt.Printf("%sWARNING: subscription %s %s%s\n", colorYellow, info.Source, strings.Join(warnings, ", "), colorReset)
+		}
+	}
+}
+
+func formatBytes(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	unit := 0
+	size := float64(bytes)
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%s", size, units[unit])
+}
+
+// formatBufferbloat 显示 bufferbloat 评级和负载下延迟的增加量
+func formatBufferbloat(result *speedtester.Result) string {
+	if result.Bufferbloat == "" {
+		return "N/A"
+	}
+	increase := max(result.DownloadLatency, result.UploadLatency) - result.Latency
+	str := fmt.Sprintf("%s (%+dms)", result.Bufferbloat, increase.Milliseconds())
+	switch result.Bufferbloat {
+	case "A+", "A":
+		return colorGreen + str + colorReset
+	case "B", "C":
+		return colorYellow + str + colorReset
+	default:
+		return colorRed + str + colorReset
+	}
+}
+
+// printTargets 配置了多个测试目标时输出每个目标的延迟和速度
+func printTargets(results []*ExtendedResult) {
+	if len(testTargets) < 2 {
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	headers := []string{"序号", "节点名称"}
+	for _, target := range testTargets {
+		if *fastMode {
+			headers = append(headers, target.Name+" 延迟")
+		} else {
+			headers = append(headers, target.Name+" 延迟", target.Name+" 下载", target.Name+" 上传")
+		}
+	}
+	table.SetHeader(headers)
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(false)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetTablePadding("\t")
+	table.SetNoWhiteSpace(true)
+
+	for i, result := range results {
+		row := []string{fmt.Sprintf("%d.", i+1), result.ProxyName}
+		for j := range testTargets {
+			// 从检查点恢复的旧结果可能没有对应的目标
+			if j >= len(result.Targets) {
+				row = append(row, "N/A")
+				if !*fastMode {
+					row = append(row, "N/A", "N/A")
+				}
+				continue
+			}
+			target := result.Targets[j]
+			if target.Throttled && target.Latency == 0 {
+				row = append(row, throttledStr)
+			} else {
+				row = append(row, target.FormatLatency())
+			}
+			if !*fastMode {
+				downloadStr, uploadStr := target.FormatDownloadSpeed(), target.FormatUploadSpeed()
+				if target.Throttled && target.DownloadSpeed == 0 {
+					downloadStr = throttledStr
+				}
+				if target.Throttled && target.UploadSpeed == 0 {
+					uploadStr = throttledStr
+				}
+				row = append(row, downloadStr, uploadStr)
+			}
+		}
+		table.Append(row)
+	}
+
+	fmt.Println()
+	table.Render()
+}
+
+// printChains 输出代理链逐跳的延迟，每一跳的延迟包含之前所有跳
+func printChains(results []*ExtendedResult) {
+	printed := false
+	for _, result := range results {
+		if len(result.Hops) == 0 {
+			continue
+		}
+		if !printed {
+			fmt.Println("\nchain latency:")
+			printed = true
+		}
+		hops := make([]string, 0, len(result.Hops)+1)
+		for _, hop := range result.Hops {
+			hops = append(hops, fmt.Sprintf("%s (%s)", hop.Name, formatLatency(hop.Latency)))
+		}
+		hops = append(hops, fmt.Sprintf("%s (%s)", result.ProxyName, result.FormatLatency()))
+		fmt.Printf("  %s\n", strings.Join(hops, " -> "))
+	}
+}
+
+// printWebSocket 输出 WebSocket 测试的握手时间、消息往返时间和吞吐量
+func printWebSocket(results []*ExtendedResult) {
+	if !*webSocket {
+		return
+	}
+	fmt.Println("\nwebsocket (upgrade / rtt / throughput):")
+	for _, result := range results {
+		if result.WebSocketUpgrade == 0 && result.WebSocketError == "" {
+			continue
+		}
+		line := fmt.Sprintf("%s / %s / %s", formatLatency(result.WebSocketUpgrade), formatLatency(result.WebSocketLatency), formatBytes(int64(result.WebSocketSpeed))+"/s")
+		if result.WebSocketError != "" {
+			line += "\t" + colorRed + result.WebSocketError + colorReset
+		}
+		fmt.Printf("  %s\t%s\n", result.ProxyName, line)
+	}
+}
+
+// printHold 输出长连接测试中每个节点连接保持的时间
+func printHold(results []*ExtendedResult) {
+	if *holdDuration <= 0 {
+		return
+	}
+	fmt.Println("\nlong-lived connection:")
+	for _, result := range results {
+		if result.HoldSurvived == 0 && result.HoldError == "" {
+			continue
+		}
+		status := colorGreen + "survived" + colorReset
+		if result.HoldFailed {
+			status = colorRed + "error: " + result.HoldError + colorReset
+		} else if result.HoldError != "" {
+			status = colorYellow + "stalled: " + result.HoldError + colorReset
+			if result.HoldReset {
+				status = colorRed + "reset: " + result.HoldError + colorReset
+			}
+		}
+		fmt.Printf("  %s\t%s\t%s\n", result.ProxyName, result.HoldSurvived.Round(time.Second), status)
+	}
+}
+
+// printAttempts 输出需要重试的节点，以及每个阶段单次测试最多尝试的次数
+func printAttempts(results []*ExtendedResult) {
+	var retried []*ExtendedResult
+	for _, result := range results {
+		if len(result.Attempts) > 0 {
+			retried = append(retried, result)
+		}
+	}
+	if len(retried) == 0 {
+		return
+	}
+	fmt.Println("\nretried:")
+	for _, result := range retried {
+		phases := make([]string, 0, len(result.Attempts))
+		for phase, attempts := range result.Attempts {
+			phases = append(phases, fmt.Sprintf("%s %d attempts", phase, attempts))
+		}
+		sort.Strings(phases)
+		fmt.Printf("  %s\t%s\n", result.ProxyName, strings.Join(phases, ", "))
+	}
+}
+
+// printBudget 设置了流量或时间预算时输出每个阶段使用的流量和时间
+func printBudget(report *speedtester.BudgetReport) {
+	if report.MaxBytes <= 0 && report.MaxDuration <= 0 {
+		return
+	}
+	used := formatBytes(report.UsedBytes)
+	if report.MaxBytes > 0 {
+		used = fmt.Sprintf("%s / %s", used, formatBytes(report.MaxBytes))
+	}
+	elapsed := report.Elapsed.Round(time.Second).String()
+	if report.MaxDuration > 0 {
+		elapsed = fmt.Sprintf("%s / %s", elapsed, report.MaxDuration)
+	}
+	fmt.Printf("\nbudget: traffic %s, time %s\n", used, elapsed)
+	for _, phase := range report.Phases {
+		fmt.Printf("  %s\t%s\t%s\n", phase.Phase, formatBytes(phase.Bytes), phase.Duration.Round(time.Millisecond))
+	}
+	if report.Shrunk+report.Skipped+report.Untested > 0 {
+		fmt.Printf("  %d nodes shrunk, %d nodes skipped download and upload, %d nodes untested\n", report.Shrunk, report.Skipped, report.Untested)
+	}
+}
+
+func formatLatency(latency time.Duration) string {
+	if latency == 0 {
+		return "N/A"
+	}
+	return fmt.Sprintf("%dms", latency.Milliseconds())
+}
+
+// formatLatencyStats 按 min/median/p90/p99/max 的顺序输出延迟分布
+func formatLatencyStats(stats *speedtester.LatencyStats) string {
+	if stats == nil {
+		return "N/A"
+	}
+	return fmt.Sprintf("%d/%d/%d/%d/%dms", stats.Min.Milliseconds(), stats.Median.Milliseconds(),
+		stats.P90.Milliseconds(), stats.P99.Milliseconds(), stats.Max.Milliseconds())
+}
+
+func printDuplicates(duplicates []*speedtester.DuplicateProxy) {
+	if len(duplicates) == 0 {
+		return
+	}
+	fmt.Printf("found %d nodes listed more than once, only the first one is tested:\n", len(duplicates))
+	for _, duplicate := range duplicates {
+		fmt.Printf("  %s (%s)\n", duplicate.Name, duplicate.Fingerprint)
+		for i := range duplicate.Names {
+			fmt.Printf("    - %s from %s\n", duplicate.Names[i], duplicate.Sources[i])
+		}
+	}
+}
+
+// tierRank 分级测试中各阶段的排序，没有分级测试时都为 0
+var tierRank = map[string]int{
+	speedtester.TierFull:    0,
+	speedtester.TierProbe:   1,
+	speedtester.TierLatency: 2,
+}
+
+// resultLess 各排序指标的比较函数，排在前面的节点更好
+var resultLess = map[string]func(a, b *ExtendedResult) bool{
+	"download": func(a, b *ExtendedResult) bool {
+		return a.DownloadSpeed > b.DownloadSpeed
+	},
+	"upload": func(a, b *ExtendedResult) bool {
+		return a.UploadSpeed > b.UploadSpeed
+	},
+	"latency": func(a, b *ExtendedResult) bool {
+		// 延迟为 0 表示测试失败，排在最后
+		if a.Latency == 0 || b.Latency == 0 {
+			return a.Latency != 0
+		}
+		return a.Latency < b.Latency
+	},
+}
+
+func countrySelectionEnabled() bool {
+	return *topPerCountry > 0 || strings.TrimSpace(*countryList) != ""
+}
+
+// selectByCountry 按国家/地区筛选节点，results 需已按指标排好序
+func selectByCountry(results []*ExtendedResult) []*ExtendedResult {
+	if !countrySelectionEnabled() {
+		return results
+	}
+
+	allowed := make(map[string]bool)
+	for _, code := range strings.Split(*countryList, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code != "" {
+			allowed[code] = true
+		}
+	}
+
+	selected := make([]*ExtendedResult, 0, len(results))
+	counts := make(map[string]int)
 	for _, result := range results {
+		code := strings.ToUpper(result.CountryCode)
+		if code == "" {
+			continue
+		}
+		if len(allowed) > 0 && !allowed[code] {
+			continue
+		}
+		if *topPerCountry > 0 && counts[code] >= *topPerCountry {
+			continue
+		}
+		counts[code]++
+		selected = append(selected, result)
+	}
+	return selected
+}
+
+func saveConfig(results []*ExtendedResult, groups []*speedtester.ProxyGroup, allProxies map[string]*speedtester.CProxy) error {
+	qualified := make([]*ExtendedResult, 0, len(results))
+	for _, result := range results {
+		// 时间预算用完后没有测试的节点
+		if result.Budget == speedtester.BudgetUntested {
+			continue
+		}
 		if *maxLatency > 0 && result.Latency > *maxLatency {
 			continue
 		}
 		if *downloadSize > 0 && *minDownloadSpeed > 0 && result.DownloadSpeed < *minDownloadSpeed*1024*1024 {
 			continue
 		}
-		if *uploadSize > 0 && *minUploadSpeed > 0 && result.UploadSpeed < *minUploadSpeed*1024*1024 {
+		// 分级测试中只进行了小文件下载测试的节点没有上传速度，只按下载速度筛选
+		if *uploadSize > 0 && *minUploadSpeed > 0 && result.Tier != speedtester.TierProbe && result.UploadSpeed < *minUploadSpeed*1024*1024 {
 			continue
 		}
+		qualified = append(qualified, result)
+	}
 
+	outputs := make(map[*speedtester.CProxy]map[string]any)
+	ordered := make([]*speedtester.CProxy, 0)
+	names := make(map[string]string)
+	for _, result := range selectByCountry(qualified) {
+		proxy := allProxies[result.ProxyName]
+		// relay 策略组测试时作为节点，没有对应的节点配置
+		if proxy == nil || result.ProxyConfig == nil {
+			continue
+		}
 		proxyConfig := result.ProxyConfig
 		if *renameNodes {
 			location, err := getIPLocation(proxyConfig["server"].(string))
-			if err != nil || location.CountryCode == "" {
-				proxies = append(proxies, proxyConfig)
-				continue
+			if err == nil && location.CountryCode != "" {
+				proxyConfig["name"] = generateNodeName(location.CountryCode, result.DownloadSpeed)
+			}
+		}
+		outputs[proxy] = proxyConfig
+		ordered = append(ordered, proxy)
+		names[result.ProxyName] = fmt.Sprint(proxyConfig["name"])
+	}
+
+	// 代理链中的前置节点即使没有通过筛选也需要输出，dialer-proxy 指向输出后的名称
+	for _, proxy := range ordered[:len(ordered):len(ordered)] {
+		for _, hop := range proxy.Chain {
+			if hop.Config != nil && outputs[hop] == nil {
+				outputs[hop] = hop.Config
+				ordered = append(ordered, hop)
+			}
+		}
+	}
+	proxies := make([]map[string]any, 0, len(ordered))
+	for _, proxy := range ordered {
+		proxyConfig := outputs[proxy]
+		if len(proxy.Chain) > 0 {
+			if hopConfig := outputs[proxy.Chain[len(proxy.Chain)-1]]; hopConfig != nil {
+				proxyConfig["dialer-proxy"] = hopConfig["name"]
 			}
-			proxyConfig["name"] = generateNodeName(location.CountryCode, result.DownloadSpeed)
 		}
 		proxies = append(proxies, proxyConfig)
 	}
 
+	// 保留策略组结构，策略组成员替换为输出的节点
 	config := &speedtester.RawConfig{
-		Proxies: proxies,
+		Proxies:     proxies,
+		ProxyGroups: speedtester.BuildGroupConfigs(speedtester.SubGroups(groups, *groupName), names),
 	}
-	
+
 	yamlData, err := yaml.Marshal(config)
 	if err != nil {
 		return err
@@ -344,10 +967,15 @@ func queryIPLocation(name string, proxy constant.Proxy, timeout time.Duration, i
 				if port, err := strconv.ParseUint(port, 10, 16); err == nil {
 					u16Port = uint16(port)
 				}
-				return proxy.DialContext(ctx, &constant.Metadata{
+				conn, err := proxy.DialContext(ctx, &constant.Metadata{
 					Host:    host,
 					DstPort: u16Port,
 				})
+				if err != nil {
+					// 标记为建立连接失败，-retry ip-lookup 可以按 dial 重试
+					return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+				}
+				return conn, nil
 			},
 		},
 	}
@@ -359,18 +987,19 @@ func queryIPLocation(name string, proxy constant.Proxy, timeout time.Duration, i
 	//randomIndex := rand.Intn(len(ipTokenArray))
 
 	for _, token := range ipTokenArray {
-        apiURLs = append(apiURLs, fmt.Sprintf("http://ipinfo.io/json?token=%s", token))
-    }
+		apiURLs = append(apiURLs, fmt.Sprintf("http://ipinfo.io/json?token=%s", token))
+	}
 
 	// 随机打乱数组 , 做api的负载均衡
 	rand.Shuffle(len(apiURLs), func(i, j int) {
 		apiURLs[i], apiURLs[j] = apiURLs[j], apiURLs[i]
 	})
-	
+
 	// 用ip.sb做最后的兜底方案
 	apiURLs = append(apiURLs, "https://api.ip.sb/geoip")
 
 	// 依次尝试每个 API
+	var lastErr error
 	for _, ip_url := range apiURLs {
 		var result map[string]interface{}
 		// 创建请求
@@ -387,6 +1016,7 @@ func queryIPLocation(name string, proxy constant.Proxy, timeout time.Duration, i
 		resp, err := client.Do(req)
 		if err != nil {
 			//fmt.Printf("Error requesting %s: %v\n", ip_url, err)
+			lastErr = err
 			continue
 		}
 
@@ -414,7 +1044,10 @@ func queryIPLocation(name string, proxy constant.Proxy, timeout time.Duration, i
 			continue
 		}
 	}
-	// 如果所有 API 都失败，返回错误
+	// 如果所有 API 都失败，返回错误，保留最后一个请求错误用于判断是否重试
+	if lastErr != nil {
+		return "", "", fmt.Errorf("all APIs failed or returned invalid data: %w", lastErr)
+	}
 	return "", "", errors.New("all APIs failed or returned invalid data")
 }
 
@@ -478,25 +1111,25 @@ var countryFlags = map[string]string{
 
 // 返回随机 User-Agent 的函数 有些获取ip的api需要设置UA
 func getRandomUserAgent() string {
-    userAgents := []string{
-        "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36",
-        "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15",
-        "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Safari/537.36",
-        "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
-        "Mozilla/5.0 (iPad; CPU OS 15_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.0 Mobile/15E148 Safari/604.1",
-        "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:105.0) Gecko/20100101 Firefox/105.0",
-        "Mozilla/5.0 (Linux; Android 13; Pixel 6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/117.0.0.0 Mobile Safari/537.36",
-        "Mozilla/5.0 (Macintosh; Intel Mac OS X 13_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/117.0.5938.88 Safari/537.36",
-        "Mozilla/5.0 (Windows NT 6.1; WOW64; rv:115.0) Gecko/20100101 Firefox/115.0",
-        "Mozilla/5.0 (X11; Linux i686; rv:91.0) Gecko/20100101 Firefox/91.0",
-        "Mozilla/5.0 (Linux; Android 10; SM-G973U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.0.0.0 Mobile Safari/537.36",
-        "Mozilla/5.0 (Macintosh; PPC Mac OS X 10_6_8) AppleWebKit/534.30 (KHTML, like Gecko) Version/5.1 Safari/534.30",
-        "Mozilla/5.0 (Windows NT 6.3; ARM; Trident/7.0; Touch; rv:11.0) like Gecko",
-        "Mozilla/5.0 (X11; Linux i686; rv:68.0) Gecko/20100101 Firefox/68.0",
-        "Mozilla/5.0 (Linux; U; Android 9; en-US; SM-J810Y Build/PPR1.180610.011) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Mobile Safari/537.36",
+	userAgents := []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15",
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (iPad; CPU OS 15_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.0 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:105.0) Gecko/20100101 Firefox/105.0",
+		"Mozilla/5.0 (Linux; Android 13; Pixel 6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/117.0.0.0 Mobile Safari/537.36",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 13_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/117.0.5938.88 Safari/537.36",
+		"Mozilla/5.0 (Windows NT 6.1; WOW64; rv:115.0) Gecko/20100101 Firefox/115.0",
+		"Mozilla/5.0 (X11; Linux i686; rv:91.0) Gecko/20100101 Firefox/91.0",
+		"Mozilla/5.0 (Linux; Android 10; SM-G973U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.0.0.0 Mobile Safari/537.36",
+		"Mozilla/5.0 (Macintosh; PPC Mac OS X 10_6_8) AppleWebKit/534.30 (KHTML, like Gecko) Version/5.1 Safari/534.30",
+		"Mozilla/5.0 (Windows NT 6.3; ARM; Trident/7.0; Touch; rv:11.0) like Gecko",
+		"Mozilla/5.0 (X11; Linux i686; rv:68.0) Gecko/20100101 Firefox/68.0",
+		"Mozilla/5.0 (Linux; U; Android 9; en-US; SM-J810Y Build/PPR1.180610.011) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Mobile Safari/537.36",
 		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Safari/537.36",
-    }
+	}
 
-    rand.Seed(time.Now().UnixNano()) // 设置随机数种子
-    return userAgents[rand.Intn(len(userAgents))]
+	rand.Seed(time.Now().UnixNano()) // 设置随机数种子
+	return userAgents[rand.Intn(len(userAgents))]
 }
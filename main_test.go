@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/faceair/clash-speedtest/speedtester"
+	"gopkg.in/yaml.v3"
+)
+
+const testConfig = `
+proxies:
+  - {name: fast, type: http, server: 127.0.0.1, port: 10001}
+  - {name: slow, type: http, server: 127.0.0.1, port: 10002}
+  - {name: untested, type: http, server: 127.0.0.1, port: 10003}
+  - {name: hop, type: http, server: 127.0.0.1, port: 10004}
+  - {name: chained, type: socks5, server: 127.0.0.1, port: 10005, dialer-proxy: hop}
+  - {name: probe, type: http, server: 127.0.0.1, port: 10006}
+proxy-groups:
+  - {name: auto, type: url-test, proxies: [fast, slow, chained]}
+  - {name: fallback, type: fallback, proxies: [slow, untested]}
+  - {name: chain, type: relay, proxies: [fast, chained]}
+  - {name: partial, type: relay, proxies: [fast, slow]}
+`
+
+func TestSaveConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(testConfig), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	st := speedtester.New(&speedtester.Config{ConfigPaths: configPath})
+	allProxies, err := st.LoadProxies(false)
+	if err != nil {
+		t.Fatalf("LoadProxies: %v", err)
+	}
+
+	output := filepath.Join(dir, "output.yaml")
+	previous := *outputPath
+	*outputPath = output
+	t.Cleanup(func() { *outputPath = previous })
+
+	result := func(name string, latency time.Duration, download, upload float64) *ExtendedResult {
+		return &ExtendedResult{Result: speedtester.Result{
+			ProxyName:     name,
+			ProxyConfig:   allProxies[name].Config,
+			Latency:       latency,
+			DownloadSpeed: download * 1024 * 1024,
+			UploadSpeed:   upload * 1024 * 1024,
+		}}
+	}
+	untested := result("untested", 0, 0, 0)
+	untested.Budget = speedtester.BudgetUntested
+	probe := result("probe", 80*time.Millisecond, 8, 0)
+	probe.Tier = speedtester.TierProbe
+	results := []*ExtendedResult{
+		result("fast", 50*time.Millisecond, 10, 5),
+		result("slow", 50*time.Millisecond, 1, 5),
+		result("chained", 100*time.Millisecond, 20, 10),
+		result("hop", 2*time.Second, 10, 5),
+		untested,
+		probe,
+	}
+	if err := saveConfig(results, st.ProxyGroups(), allProxies); err != nil {
+		t.Fatalf("saveConfig: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	var saved speedtester.RawConfig
+	if err := yaml.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("unmarshal output: %v", err)
+	}
+
+	// hop 延迟超过 max-latency，但作为 chained 的前置节点仍然输出，probe 没有上传速度但按下载速度通过筛选
+	var names []string
+	for _, proxy := range saved.Proxies {
+		names = append(names, proxy["name"].(string))
+		if proxy["name"] == "chained" && proxy["dialer-proxy"] != "hop" {
+			t.Errorf("chained dialer-proxy = %v, want hop", proxy["dialer-proxy"])
+		}
+	}
+	if want := []string{"fast", "chained", "probe", "hop"}; !slices.Equal(names, want) {
+		t.Errorf("proxies = %v, want %v", names, want)
+	}
+
+	// 没有成员通过筛选的策略组和缺少任何一跳的 relay 策略组不输出
+	var groups []string
+	for _, group := range saved.ProxyGroups {
+		groups = append(groups, group["name"].(string))
+	}
+	if want := []string{"auto", "chain"}; !slices.Equal(groups, want) {
+		t.Fatalf("proxy groups = %v, want %v", groups, want)
+	}
+	var members []string
+	for _, member := range saved.ProxyGroups[0]["proxies"].([]any) {
+		members = append(members, member.(string))
+	}
+	if want := []string{"fast", "chained"}; !slices.Equal(members, want) {
+		t.Errorf("auto members = %v, want %v", members, want)
+	}
+}
@@ -0,0 +1,193 @@
+package speedtester
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// minBudgetSize 预算不足时每个测试目标至少使用的下载和上传字节数，不够时跳过下载和上传测试
+const minBudgetSize = 1024 * 1024
+
+// 预算不足时对节点的处理
+const (
+	// BudgetShrunk 按剩余流量缩小了下载和上传大小
+	BudgetShrunk = "shrunk"
+	// BudgetSkipped 跳过了下载和上传测试，只测试延迟
+	BudgetSkipped = "skipped"
+	// BudgetUntested 时间预算已经用完，没有测试
+	BudgetUntested = "untested"
+)
+
+// 除 latency、download、upload、ip-lookup 之外记录用量的测试阶段
+const (
+	PhaseWebSocket = "websocket"
+	PhaseHold      = "hold"
+)
+
+// PhaseUsage 一个测试阶段使用的流量和时间，Duration 为各节点测试时间之和
+type PhaseUsage struct {
+	Phase    string        `json:"phase"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// BudgetReport 预算的使用情况，MaxBytes 和 MaxDuration 为 0 表示不限制
+type BudgetReport struct {
+	MaxBytes    int64         `json:"max_bytes"`
+	MaxDuration time.Duration `json:"max_duration"`
+	UsedBytes   int64         `json:"used_bytes"`
+	Elapsed     time.Duration `json:"elapsed"`
+	Phases      []*PhaseUsage `json:"phases"`
+	// 因为预算不足缩小、跳过下载和上传测试，以及没有测试的节点数量
+	Shrunk   int `json:"shrunk"`
+	Skipped  int `json:"skipped"`
+	Untested int `json:"untested"`
+}
+
+// budget 记录各测试阶段的用量，并在预算不足时决定每个节点的下载和上传大小
+type budget struct {
+	mu             sync.Mutex
+	start          time.Time
+	usage          map[string]*PhaseUsage
+	actions        map[string]int
+	remainingNodes int
+	// latencies 已经测试过的节点的延迟，延迟高于中位数的节点优先级较低
+	latencies []time.Duration
+}
+
+func newBudget() *budget {
+	return &budget{
+		start:   time.Now(),
+		usage:   make(map[string]*PhaseUsage),
+		actions: make(map[string]int),
+	}
+}
+
+func (st *SpeedTester) budgetEnabled() bool {
+	return st.config.MaxTotalBytes > 0 || st.config.MaxDuration > 0
+}
+
+// RecordUsage 记录 phase 使用的流量和时间
+func (st *SpeedTester) RecordUsage(phase string, bytes int64, duration time.Duration) {
+	b := st.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage, ok := b.usage[phase]
+	if !ok {
+		usage = &PhaseUsage{Phase: phase}
+		b.usage[phase] = usage
+	}
+	usage.Bytes += bytes
+	usage.Duration += duration
+}
+
+// BudgetReport 返回到目前为止的预算使用情况，内置阶段按测试顺序排列
+func (st *SpeedTester) BudgetReport() *BudgetReport {
+	b := st.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	report := &BudgetReport{
+		MaxBytes:    st.config.MaxTotalBytes,
+		MaxDuration: st.config.MaxDuration,
+		Elapsed:     time.Since(b.start),
+		Shrunk:      b.actions[BudgetShrunk],
+		Skipped:     b.actions[BudgetSkipped],
+		Untested:    b.actions[BudgetUntested],
+	}
+	// 自定义阶段按名称排在内置阶段之后
+	phases := []string{PhaseLatency, PhaseDownload, PhaseUpload, PhaseWebSocket, PhaseHold, PhaseIPLookup}
+	var custom []string
+	for phase := range b.usage {
+		if !slices.Contains(phases, phase) {
+			custom = append(custom, phase)
+		}
+	}
+	slices.Sort(custom)
+	for _, phase := range append(phases, custom...) {
+		if usage, ok := b.usage[phase]; ok {
+			report.Phases = append(report.Phases, usage)
+			report.UsedBytes += usage.Bytes
+		}
+	}
+	return report
+}
+
+// timeExhausted 时间预算已经用完
+func (st *SpeedTester) timeExhausted() bool {
+	return st.config.MaxDuration > 0 && time.Since(st.budget.start) >= st.config.MaxDuration
+}
+
+// startNodes 开始测试 count 个节点，剩余节点数用于平均分配剩余的预算
+func (st *SpeedTester) startNodes(count int) {
+	st.budget.mu.Lock()
+	defer st.budget.mu.Unlock()
+	st.budget.remainingNodes += count
+}
+
+// finishNode 一个节点测试完成，action 不为空时记录预算不足时的处理
+func (st *SpeedTester) finishNode(action string) {
+	b := st.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remainingNodes--
+	if action != "" {
+		b.actions[action]++
+	}
+}
+
+// throughputPlan 根据剩余预算和节点延迟返回测试目标的下载和上传大小，
+// 剩余流量平均分配给剩余的节点和测试目标，不够 minBudgetSize 时只有延迟低于已测试节点中位数的节点继续测试；
+// 剩余时间平均到每个节点不够下载和上传的超时时间时同样跳过低优先级的节点
+func (st *SpeedTester) throughputPlan(latency time.Duration, upload bool) (int, int, string) {
+	downloadSize, uploadSize := st.config.DownloadSize, 0
+	if upload {
+		uploadSize = st.config.UploadSize
+	}
+	if !st.budgetEnabled() {
+		return downloadSize, uploadSize, ""
+	}
+
+	b := st.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lowPriority := false
+	if len(b.latencies) > 0 {
+		sorted := slices.Clone(b.latencies)
+		slices.Sort(sorted)
+		lowPriority = latency > sorted[len(sorted)/2]
+	}
+	b.latencies = append(b.latencies, latency)
+	nodes := max(b.remainingNodes, 1)
+
+	if st.config.MaxDuration > 0 {
+		remaining := st.config.MaxDuration - time.Since(b.start)
+		needed := st.config.Timeout
+		if uploadSize > 0 {
+			needed *= 2
+		}
+		if remaining < needed || (lowPriority && remaining/time.Duration(nodes) < needed) {
+			return 0, 0, BudgetSkipped
+		}
+	}
+
+	if st.config.MaxTotalBytes > 0 {
+		var used int64
+		for _, usage := range b.usage {
+			used += usage.Bytes
+		}
+		remaining := st.config.MaxTotalBytes - used
+		allowance := remaining / int64(nodes*len(st.targets()))
+		planned := int64(downloadSize + uploadSize)
+		switch {
+		case planned == 0 || planned <= allowance:
+			return downloadSize, uploadSize, ""
+		case allowance < minBudgetSize && (lowPriority || remaining < minBudgetSize):
+			return 0, 0, BudgetSkipped
+		}
+		allowance = max(allowance, minBudgetSize)
+		scale := float64(allowance) / float64(planned)
+		return int(float64(downloadSize) * scale), int(float64(uploadSize) * scale), BudgetShrunk
+	}
+	return downloadSize, uploadSize, ""
+}
@@ -0,0 +1,80 @@
+package speedtester
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// loadedProbeInterval 下载和上传期间测试延迟的间隔
+const loadedProbeInterval = 200 * time.Millisecond
+
+// startLoadedProbe 在下载或上传期间持续测试延迟，调用返回的函数停止测试并得到平均延迟，没有成功的测试时为 0
+func (st *SpeedTester) startLoadedProbe(proxy constant.Proxy, probe latencyProbe) func() time.Duration {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan time.Duration, 1)
+
+	go func() {
+		client := st.createClient(proxy, st.config.Timeout)
+		defer client.CloseIdleConnections()
+
+		var total time.Duration
+		var count int
+		ticker := time.NewTicker(loadedProbeInterval)
+		defer ticker.Stop()
+		for ctx.Err() == nil {
+			resp, start, err := st.do(client, func() (*http.Request, error) {
+				return http.NewRequestWithContext(ctx, probe.method, probe.url, nil)
+			})
+			if err == nil {
+				latency := time.Since(start)
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
+					total += latency
+					count++
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+			}
+		}
+		if count == 0 {
+			done <- 0
+		} else {
+			done <- total / time.Duration(count)
+		}
+	}()
+
+	return func() time.Duration {
+		cancel()
+		return <-done
+	}
+}
+
+// bufferbloatGrade 按负载下延迟相对空闲延迟的增加量评级，与常见的 bufferbloat 测试一致
+func bufferbloatGrade(idle, download, upload time.Duration) string {
+	if idle == 0 || (download == 0 && upload == 0) {
+		return ""
+	}
+	increase := max(download, upload) - idle
+	switch {
+	case increase < 5*time.Millisecond:
+		return "A+"
+	case increase < 30*time.Millisecond:
+		return "A"
+	case increase < 60*time.Millisecond:
+		return "B"
+	case increase < 200*time.Millisecond:
+		return "C"
+	case increase < 400*time.Millisecond:
+		return "D"
+	default:
+		return "F"
+	}
+}
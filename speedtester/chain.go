@@ -0,0 +1,213 @@
+package speedtester
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/proxydialer"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+)
+
+// parseProxy 解析节点，dialer-proxy 由 linkChains 直接连接到前置节点，
+// 不经过 mihomo 在 tunnel.Proxies() 中按名称查找，原始配置保持不变
+func parseProxy(config map[string]any) (constant.Proxy, error) {
+	if _, ok := config["dialer-proxy"]; !ok {
+		return adapter.ParseProxy(config)
+	}
+	parseConfig := make(map[string]any, len(config))
+	for key, value := range config {
+		parseConfig[key] = value
+	}
+	delete(parseConfig, "dialer-proxy")
+	return adapter.ParseProxy(parseConfig)
+}
+
+// relayProxy 依次经过 hops 中的节点再由最后一跳连接目标，与 mihomo 的 relay 策略组实现一致
+type relayProxy struct {
+	constant.Proxy
+	name string
+	hops []constant.Proxy
+}
+
+// newRelay 创建经过 hops 再由 last 连接目标的节点，嵌套的 relayProxy 展开为依次拨号的节点，
+// 否则 proxydialer 调用内层节点的 DialContextWithDialer 时会跳过它自己的前置节点
+func newRelay(name string, last constant.Proxy, hops []constant.Proxy) *relayProxy {
+	var flat []constant.Proxy
+	for _, hop := range hops {
+		flat = append(flat, chainAdapters(hop)...)
+	}
+	lastAdapters := chainAdapters(last)
+	flat = append(flat, lastAdapters[:len(lastAdapters)-1]...)
+	return &relayProxy{Proxy: lastAdapters[len(lastAdapters)-1], name: name, hops: flat}
+}
+
+// chainAdapters 返回经过 proxy 连接时依次拨号的节点
+func chainAdapters(proxy constant.Proxy) []constant.Proxy {
+	relay, ok := proxy.(*relayProxy)
+	if !ok {
+		return []constant.Proxy{proxy}
+	}
+	return append(append([]constant.Proxy{}, relay.hops...), relay.Proxy)
+}
+
+func (r *relayProxy) Name() string {
+	return r.name
+}
+
+func (r *relayProxy) Type() constant.AdapterType {
+	if r.name != r.Proxy.Name() {
+		return constant.Relay
+	}
+	return r.Proxy.Type()
+}
+
+func (r *relayProxy) dialer() constant.Dialer {
+	var d constant.Dialer = dialer.NewDialer()
+	for _, hop := range r.hops {
+		d = proxydialer.New(hop, d, false)
+	}
+	return d
+}
+
+func (r *relayProxy) DialContext(ctx context.Context, metadata *constant.Metadata) (constant.Conn, error) {
+	return r.Proxy.DialContextWithDialer(ctx, r.dialer(), metadata)
+}
+
+func (r *relayProxy) ListenPacketContext(ctx context.Context, metadata *constant.Metadata) (constant.PacketConn, error) {
+	return r.Proxy.ListenPacketWithDialer(ctx, r.dialer(), metadata)
+}
+
+// linkChains 为一个来源中的节点建立代理链：
+// dialer-proxy 可以指向节点、策略组（使用第一个可用成员）或 relay 策略组，
+// relay 策略组本身会作为一个节点加入 proxies 参与测试。引用不存在或者成环的节点会被移除，
+// 成员不完整的 relay 策略组不参与测试
+func linkChains(proxies map[string]*CProxy, local map[string]*CProxy, groups []*sourceGroup) {
+	registry := make(map[string]*CProxy, len(local))
+	for name, proxy := range local {
+		registry[name] = proxy
+	}
+
+	groupIndex := make(map[string]*sourceGroup, len(groups))
+	for _, group := range groups {
+		groupIndex[group.name] = group
+	}
+	var representative func(name string, visited map[string]bool) *CProxy
+	representative = func(name string, visited map[string]bool) *CProxy {
+		group := groupIndex[name]
+		if group == nil || visited[name] {
+			return nil
+		}
+		visited[name] = true
+		for _, item := range group.items {
+			if item.proxy != nil {
+				return item.proxy
+			}
+			if proxy := representative(item.group, visited); proxy != nil {
+				return proxy
+			}
+		}
+		return nil
+	}
+	for _, group := range groups {
+		if proxy := representative(group.name, make(map[string]bool)); proxy != nil {
+			registry[group.name] = proxy
+		}
+	}
+
+	// resolve 先连接前置节点，再让节点经过前置节点拨号
+	resolved := make(map[*CProxy]bool)
+	var resolve func(proxy *CProxy, visiting map[*CProxy]bool) error
+	resolve = func(proxy *CProxy, visiting map[*CProxy]bool) error {
+		if resolved[proxy] {
+			return nil
+		}
+		dialerProxy, _ := proxy.Config["dialer-proxy"].(string)
+		if dialerProxy == "" {
+			resolved[proxy] = true
+			return nil
+		}
+		if visiting[proxy] {
+			return fmt.Errorf("dialer-proxy loop detected at %s", proxy.Name())
+		}
+		hop := registry[dialerProxy]
+		if hop == nil {
+			return fmt.Errorf("dialer-proxy %s not found", dialerProxy)
+		}
+		visiting[proxy] = true
+		if err := resolve(hop, visiting); err != nil {
+			return err
+		}
+		proxy.Chain = append(append([]*CProxy{}, hop.Chain...), hop)
+		proxy.Proxy = newRelay(proxy.Name(), proxy.Proxy, []constant.Proxy{hop.Proxy})
+		resolved[proxy] = true
+		return nil
+	}
+
+	for _, group := range groups {
+		if group.config["type"] != "relay" {
+			continue
+		}
+		hops := make([]*CProxy, 0, len(group.items))
+		for _, item := range group.items {
+			hop := item.proxy
+			if hop == nil {
+				hop = registry[item.group]
+			}
+			if hop == nil {
+				break
+			}
+			if err := resolve(hop, make(map[*CProxy]bool)); err != nil {
+				log.Warnln("relay group %s is skipped: %s", group.name, err)
+				break
+			}
+			hops = append(hops, hop)
+		}
+		// proxies 中引用不存在的节点在 resolveGroups 中已经被去掉
+		if len(hops) != len(group.items) || len(hops) < len(toStringList(group.config["proxies"])) {
+			log.Warnln("relay group %s is skipped: some proxies are not available", group.name)
+			continue
+		}
+		if len(hops) < 2 {
+			log.Warnln("relay group %s needs at least 2 proxies", group.name)
+			continue
+		}
+		relay := newRelayProxy(group.name, hops)
+		relay.Source = hops[len(hops)-1].Source
+		registry[group.name] = relay
+		proxies[group.name] = relay
+	}
+
+	for name, proxy := range proxies {
+		if err := resolve(proxy, make(map[*CProxy]bool)); err != nil {
+			log.Warnln("proxy %s is skipped: %s", name, err)
+			delete(proxies, name)
+		}
+	}
+}
+
+// newRelayProxy 创建 relay 节点，Chain 中依次是经过前 1、2……跳的部分链路，用于逐跳测试延迟
+func newRelayProxy(name string, hops []*CProxy) *CProxy {
+	chain := make([]*CProxy, 0, len(hops)-1)
+	adapters := make([]constant.Proxy, 0, len(hops))
+	for i, hop := range hops {
+		if i == len(hops)-1 {
+			break
+		}
+		adapters = append(adapters, hop.Proxy)
+		partial := hop
+		if i > 0 {
+			partial = &CProxy{
+				Proxy: newRelay(hop.Name(), hop.Proxy, adapters[:i]),
+			}
+		}
+		chain = append(chain, partial)
+	}
+	last := hops[len(hops)-1]
+	return &CProxy{
+		Proxy: newRelay(name, last.Proxy, adapters),
+		Chain: chain,
+	}
+}
@@ -0,0 +1,104 @@
+package speedtester
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// NewDownloadServer download-server 的接口：/__down、/__up 与 Cloudflare 测速接口一致，
+// /__echo 和 /__ws 用于长连接和 WebSocket 测试
+func NewDownloadServer() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<h1>SpeedTest Server</h1>`))
+	})
+
+	mux.HandleFunc("/__down", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		byteSize, err := strconv.Atoi(r.URL.Query().Get("bytes"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=speedtest-%d.bin", byteSize))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+
+		reader := NewZeroReader(byteSize)
+		io.Copy(w, reader)
+	})
+
+	mux.HandleFunc("/__up", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		io.Copy(io.Discard, r.Body)
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// 升级为原始 TCP 连接后原样返回收到的数据，连接一直保持到客户端关闭，用于长连接测试
+	mux.HandleFunc("/__echo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusUpgradeRequired)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		if err := buf.Flush(); err != nil {
+			return
+		}
+		io.Copy(conn, buf)
+	})
+
+	// WebSocket echo，原样返回收到的消息
+	mux.HandleFunc("/__ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			data, op, err := wsutil.ReadClientData(conn)
+			if err != nil {
+				return
+			}
+			// 帧头和数据合并成一次写入
+			frame, err := ws.CompileFrame(ws.NewFrame(op, true, data))
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	})
+
+	return mux
+}
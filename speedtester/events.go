@@ -0,0 +1,256 @@
+package speedtester
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// progressInterval 下载、上传等阶段发送 PhaseProgressEvent 的间隔
+const progressInterval = 500 * time.Millisecond
+
+// Event 测试过程中的事件，使用 type switch 区分具体类型：
+// *ProxyLoadedEvent、*PhaseStartedEvent、*PhaseProgressEvent、*PhaseFinishedEvent、*ProxyFinishedEvent、*RunFinishedEvent
+type Event interface {
+	event()
+}
+
+// ProxyLoadedEvent 加载到一个待测试的节点，只由 Run 发送
+type ProxyLoadedEvent struct {
+	Name  string
+	Proxy *CProxy
+}
+
+// PhaseStartedEvent 节点开始一个测试阶段，Phase 为 latency、download、upload、websocket、hold 等
+type PhaseStartedEvent struct {
+	ProxyName string
+	Phase     string
+}
+
+// PhaseProgressEvent 测试阶段进行中，Bytes 为到目前为止传输的字节数
+type PhaseProgressEvent struct {
+	ProxyName string
+	Phase     string
+	Bytes     int64
+	Elapsed   time.Duration
+}
+
+// PhaseFinishedEvent 测试阶段结束，Bytes 包含重试时传输的字节数
+type PhaseFinishedEvent struct {
+	ProxyName string
+	Phase     string
+	Bytes     int64
+	Elapsed   time.Duration
+}
+
+// ProxyFinishedEvent 节点测试完成
+type ProxyFinishedEvent struct {
+	Result *Result
+}
+
+// RunFinishedEvent 所有节点测试完成，Err 为加载节点失败或 ctx 被取消的原因
+type RunFinishedEvent struct {
+	Tested  int
+	Elapsed time.Duration
+	Budget  *BudgetReport
+	Err     error
+}
+
+func (*ProxyLoadedEvent) event()   {}
+func (*PhaseStartedEvent) event()  {}
+func (*PhaseProgressEvent) event() {}
+func (*PhaseFinishedEvent) event() {}
+func (*ProxyFinishedEvent) event() {}
+func (*RunFinishedEvent) event()   {}
+
+// Run 加载并测试所有节点，按发生顺序发送事件，RunFinishedEvent 之后关闭 channel
+func (st *SpeedTester) Run(ctx context.Context, stashCompatible bool) <-chan Event {
+	events := make(chan Event, 64)
+	go func() {
+		defer close(events)
+		start := time.Now()
+		proxies, err := st.LoadProxies(stashCompatible)
+		if err != nil {
+			events <- &RunFinishedEvent{Elapsed: time.Since(start), Err: err}
+			return
+		}
+		names := make([]string, 0, len(proxies))
+		for name := range proxies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sendEvent(ctx, events, &ProxyLoadedEvent{Name: name, Proxy: proxies[name]})
+		}
+		st.stream(ctx, proxies, events, start)
+	}()
+	return events
+}
+
+// Stream 测试 proxies 中的节点，按发生顺序发送事件，RunFinishedEvent 之后关闭 channel，
+// ctx 取消后不再开始测试新的节点，也不再发送阶段事件，调用方需要继续读取到 channel 关闭
+func (st *SpeedTester) Stream(ctx context.Context, proxies map[string]*CProxy) <-chan Event {
+	events := make(chan Event, 64)
+	go func() {
+		defer close(events)
+		st.stream(ctx, proxies, events, time.Now())
+	}()
+	return events
+}
+
+func (st *SpeedTester) stream(ctx context.Context, proxies map[string]*CProxy, events chan<- Event, start time.Time) {
+	// 每次运行使用自己的 emitter，同时运行的 Stream 和 Run 的事件不会发送到彼此的 channel
+	emit := emitter(func(event Event) { sendEvent(ctx, events, event) })
+
+	// 节点完成和测试结束的事件在 ctx 取消后仍然发送
+	tested := 0
+	st.testProxies(ctx, proxies, emit, func(result *Result) {
+		tested++
+		events <- &ProxyFinishedEvent{Result: result}
+	})
+	events <- &RunFinishedEvent{
+		Tested:  tested,
+		Elapsed: time.Since(start),
+		Budget:  st.BudgetReport(),
+		Err:     ctx.Err(),
+	}
+}
+
+// sendEvent 发送事件，ctx 取消后丢弃，避免调用方不再读取时阻塞测试
+func sendEvent(ctx context.Context, events chan<- Event, event Event) {
+	select {
+	case events <- event:
+	case <-ctx.Done():
+	}
+}
+
+// emitter 发送一次运行中的阶段事件，为 nil 时丢弃事件
+type emitter func(Event)
+
+func (e emitter) send(event Event) {
+	if e != nil {
+		e(event)
+	}
+}
+
+// phaseTracker 记录一个测试阶段传输的字节数，开始和结束时发送事件，进行中定期发送进度，结束时计入预算用量
+type phaseTracker struct {
+	st        *SpeedTester
+	emit      emitter
+	proxyName string
+	phase     string
+	start     time.Time
+	bytes     atomic.Int64
+	stop      chan struct{}
+	done      sync.WaitGroup
+}
+
+func (st *SpeedTester) startPhase(emit emitter, proxyName, phase string) *phaseTracker {
+	t := &phaseTracker{
+		st:        st,
+		emit:      emit,
+		proxyName: proxyName,
+		phase:     phase,
+		start:     time.Now(),
+		stop:      make(chan struct{}),
+	}
+	emit.send(&PhaseStartedEvent{ProxyName: proxyName, Phase: phase})
+
+	t.done.Add(1)
+	go func() {
+		defer t.done.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				emit.send(&PhaseProgressEvent{
+					ProxyName: proxyName,
+					Phase:     phase,
+					Bytes:     t.bytes.Load(),
+					Elapsed:   time.Since(t.start),
+				})
+			}
+		}
+	}()
+	return t
+}
+
+func (t *phaseTracker) finish() {
+	close(t.stop)
+	t.done.Wait()
+	elapsed := time.Since(t.start)
+	bytes := t.bytes.Load()
+	t.st.RecordUsage(t.phase, bytes, elapsed)
+	t.emit.send(&PhaseFinishedEvent{
+		ProxyName: t.proxyName,
+		Phase:     t.phase,
+		Bytes:     bytes,
+		Elapsed:   elapsed,
+	})
+}
+
+// countReader 把读取的字节数计入 tracker，tracker 为 nil 时不计数
+func (t *phaseTracker) countReader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &countingReader{r: r, bytes: &t.bytes}
+}
+
+// countProxy 把通过 proxy 建立的 TCP 连接读写的字节数计入 tracker，包括请求头和响应头，
+// 用于延迟测试等没有响应体的请求。HTTP/3 使用的 UDP 不计数，tracker 为 nil 时不计数
+func (t *phaseTracker) countProxy(proxy constant.Proxy) constant.Proxy {
+	if t == nil {
+		return proxy
+	}
+	return &trafficProxy{Proxy: proxy, bytes: &t.bytes}
+}
+
+type trafficProxy struct {
+	constant.Proxy
+	bytes *atomic.Int64
+}
+
+func (p *trafficProxy) DialContext(ctx context.Context, metadata *constant.Metadata) (constant.Conn, error) {
+	conn, err := p.Proxy.DialContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &trafficConn{Conn: conn, bytes: p.bytes}, nil
+}
+
+type trafficConn struct {
+	constant.Conn
+	bytes *atomic.Int64
+}
+
+func (c *trafficConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *trafficConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r     io.Reader
+	bytes *atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.bytes.Add(int64(n))
+	return n, err
+}
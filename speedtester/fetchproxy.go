@@ -0,0 +1,68 @@
+package speedtester
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/constant"
+	"gopkg.in/yaml.v3"
+)
+
+// resolveFetchProxy 解析 FetchProxy，支持 http(s)/socks5 地址，或者本地配置文件中的节点名称
+func (st *SpeedTester) resolveFetchProxy() (constant.Proxy, error) {
+	if st.config.FetchProxy == "" {
+		return nil, nil
+	}
+
+	if u, err := url.Parse(st.config.FetchProxy); err == nil && u.Host != "" {
+		config := map[string]any{
+			"name":   "fetch-proxy",
+			"server": u.Hostname(),
+			"port":   u.Port(),
+		}
+		switch u.Scheme {
+		case "http", "https":
+			config["type"] = "http"
+			config["tls"] = u.Scheme == "https"
+			if u.Port() == "" {
+				config["port"] = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+			}
+		case "socks5", "socks5h":
+			config["type"] = "socks5"
+			if u.Port() == "" {
+				config["port"] = "1080"
+			}
+		default:
+			return nil, fmt.Errorf("unsupported fetch proxy scheme: %s", u.Scheme)
+		}
+		if u.User != nil {
+			config["username"] = u.User.Username()
+			config["password"], _ = u.User.Password()
+		}
+		return adapter.ParseProxy(config)
+	}
+
+	// 订阅本身可能需要通过代理才能下载，所以只在本地配置文件中查找节点
+	for _, source := range st.sources() {
+		if strings.HasPrefix(source.Path, "http") {
+			continue
+		}
+		body, err := os.ReadFile(source.Path)
+		if err != nil {
+			continue
+		}
+		rawCfg := &RawConfig{}
+		if err := yaml.Unmarshal(body, rawCfg); err != nil {
+			continue
+		}
+		for _, config := range rawCfg.Proxies {
+			if config["name"] == st.config.FetchProxy {
+				return adapter.ParseProxy(config)
+			}
+		}
+	}
+	return nil, fmt.Errorf("fetch proxy %s not found in local config files", st.config.FetchProxy)
+}
@@ -0,0 +1,106 @@
+package speedtester
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// credentialKeys 参与指纹计算的凭据字段
+var credentialKeys = []string{
+	"username", "password", "uuid", "auth", "auth-str", "token", "psk", "private-key",
+}
+
+// transportPaths 参与指纹计算的传输层字段
+var transportPaths = [][]string{
+	{"network"},
+	{"ws-opts", "path"},
+	{"ws-opts", "headers", "Host"},
+	{"h2-opts", "path"},
+	{"http-opts", "path"},
+	{"grpc-opts", "grpc-service-name"},
+	{"servername"},
+	{"sni"},
+}
+
+// Fingerprint 返回节点的稳定标识，由规范化后的类型、服务器、端口、凭据、传输层和 SNI 计算得出，与节点名称无关，
+// 经过代理链连接的节点还包含前置节点的指纹
+func (p *CProxy) Fingerprint() string {
+	if p.Config == nil {
+		return "name|" + p.Name()
+	}
+	if len(p.Chain) > 0 {
+		return p.fingerprint() + " via " + p.Chain[len(p.Chain)-1].Fingerprint()
+	}
+	return p.fingerprint()
+}
+
+func (p *CProxy) fingerprint() string {
+	h := sha256.New()
+	for _, key := range credentialKeys {
+		if value, ok := p.Config[key]; ok {
+			fmt.Fprintf(h, "%s=%v;", key, value)
+		}
+	}
+	for _, path := range transportPaths {
+		if value := lookupConfig(p.Config, path...); value != "" {
+			fmt.Fprintf(h, "%s=%s;", strings.Join(path, "."), value)
+		}
+	}
+
+	server := strings.ToLower(strings.TrimSpace(fmt.Sprint(p.Config["server"])))
+	server = convertMappedIPv6ToIPv4(strings.Trim(server, "[]"))
+	return fmt.Sprintf("%s|%s|%d|%x", strings.ToLower(p.Type().String()), server, configPort(p.Config["port"]), h.Sum(nil)[:8])
+}
+
+// lookupConfig 按路径读取嵌套配置，不存在时返回空字符串，tcp 等默认传输层视为空
+func lookupConfig(config map[string]any, path ...string) string {
+	var value any = config
+	for _, key := range path {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		if value, ok = m[key]; !ok {
+			return ""
+		}
+	}
+	s := strings.TrimSpace(fmt.Sprint(value))
+	if path[0] == "network" && s == "tcp" {
+		return ""
+	}
+	return s
+}
+
+func configPort(value any) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		port, _ := strconv.Atoi(strings.TrimSpace(v))
+		return port
+	}
+	return 0
+}
+
+// DuplicateProxy 多个来源中指向同一服务器的节点，只保留第一个用于测试
+type DuplicateProxy struct {
+	Name        string   `json:"name"`
+	Fingerprint string   `json:"fingerprint"`
+	Names       []string `json:"names"`
+	Sources     []string `json:"sources"`
+}
+
+// sourceLabel 去掉订阅地址中的查询参数，避免在输出中泄露 token
+func sourceLabel(configPath string) string {
+	if u, err := url.Parse(configPath); err == nil && u.Scheme != "" && u.Host != "" {
+		u.RawQuery = ""
+		u.User = nil
+		return u.String()
+	}
+	return configPath
+}
@@ -0,0 +1,339 @@
+package speedtester
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/metacubex/mihomo/log"
+)
+
+// builtinPolicies 策略组中可以直接引用的内置策略
+var builtinPolicies = map[string]bool{
+	"DIRECT": true, "REJECT": true, "REJECT-DROP": true, "PASS": true, "COMPATIBLE": true, "GLOBAL": true,
+}
+
+// ProxyGroup 解析后的策略组，Proxies 为测试节点的名称，Groups 为嵌套的策略组和内置策略，
+// Members 按配置中的顺序包含两者
+type ProxyGroup struct {
+	Name    string
+	Config  map[string]any
+	Members []string
+	Proxies []string
+	Groups  []string
+	Source  string
+}
+
+// groupItem 策略组成员，proxy 和 group 只有一个不为空
+type groupItem struct {
+	proxy *CProxy
+	group string
+}
+
+// sourceGroup 单个配置文件中的策略组，成员在去重和重命名之前解析
+type sourceGroup struct {
+	name   string
+	config map[string]any
+	items  []groupItem
+	source string
+}
+
+// resolveGroups 解析 proxy-groups 的成员，支持 proxies、use、include-all 以及 filter、exclude-filter、exclude-type
+func resolveGroups(configs []map[string]any, local map[string]*CProxy, localOrder []string, providers map[string][]*CProxy, providerOrder []string, source string) ([]*sourceGroup, error) {
+	names := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		name, _ := config["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("proxy group missing name")
+		}
+		names[name] = true
+	}
+
+	groups := make([]*sourceGroup, 0, len(configs))
+	for _, config := range configs {
+		group := &sourceGroup{
+			name:   config["name"].(string),
+			config: config,
+			source: source,
+		}
+
+		for _, item := range toStringList(config["proxies"]) {
+			switch {
+			case names[item], builtinPolicies[item]:
+				group.items = append(group.items, groupItem{group: item})
+			case local[item] != nil:
+				group.items = append(group.items, groupItem{proxy: local[item]})
+			default:
+				log.Warnln("proxy group %s: proxy %s not found", group.name, item)
+			}
+		}
+
+		// filter 只作用于 use 和 include-all 引入的节点，与 mihomo 一致
+		var candidates []*CProxy
+		includeAll, _ := config["include-all"].(bool)
+		includeAllProxies, _ := config["include-all-proxies"].(bool)
+		includeAllProviders, _ := config["include-all-providers"].(bool)
+		if includeAll || includeAllProxies {
+			for _, name := range localOrder {
+				candidates = append(candidates, local[name])
+			}
+		}
+		use := toStringList(config["use"])
+		if includeAll || includeAllProviders {
+			use = providerOrder
+		}
+		for _, name := range use {
+			pdProxies, ok := providers[name]
+			if !ok {
+				log.Warnln("proxy group %s: provider %s not found", group.name, name)
+				continue
+			}
+			candidates = append(candidates, pdProxies...)
+		}
+		filtered, err := filterGroupProxies(config, candidates)
+		if err != nil {
+			return nil, fmt.Errorf("proxy group %s: %w", group.name, err)
+		}
+		for _, proxy := range filtered {
+			group.items = append(group.items, groupItem{proxy: proxy})
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func filterGroupProxies(config map[string]any, proxies []*CProxy) ([]*CProxy, error) {
+	filter, _ := config["filter"].(string)
+	excludeFilter, _ := config["exclude-filter"].(string)
+	excludeType, _ := config["exclude-type"].(string)
+	if filter == "" && excludeFilter == "" && excludeType == "" {
+		return proxies, nil
+	}
+
+	var filterRegs []*regexp2.Regexp
+	if filter != "" {
+		for _, expr := range strings.Split(filter, "`") {
+			reg, err := regexp2.Compile(expr, regexp2.None)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter regex: %w", err)
+			}
+			filterRegs = append(filterRegs, reg)
+		}
+	}
+	var excludeRegs []*regexp2.Regexp
+	if excludeFilter != "" {
+		for _, expr := range strings.Split(excludeFilter, "`") {
+			reg, err := regexp2.Compile(expr, regexp2.None)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclude-filter regex: %w", err)
+			}
+			excludeRegs = append(excludeRegs, reg)
+		}
+	}
+	var excludeTypes []string
+	if excludeType != "" {
+		excludeTypes = strings.Split(excludeType, "|")
+	}
+
+	result := make([]*CProxy, 0, len(proxies))
+	for _, proxy := range proxies {
+		name := proxy.Name()
+		if containsFold(excludeTypes, proxy.Type().String()) {
+			continue
+		}
+		if matchAny(excludeRegs, name) {
+			continue
+		}
+		if len(filterRegs) > 0 && !matchAny(filterRegs, name) {
+			continue
+		}
+		result = append(result, proxy)
+	}
+	return result, nil
+}
+
+func matchAny(regs []*regexp2.Regexp, s string) bool {
+	for _, reg := range regs {
+		if matched, _ := reg.MatchString(s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func toStringList(value any) []string {
+	list, _ := value.([]any)
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// finalizeGroups 把策略组成员转换成去重和过滤后的节点名称，多个来源中的同名策略组只保留第一个
+func finalizeGroups(sourceGroups []*sourceGroup, finalNames map[*CProxy]string, proxies map[string]*CProxy) []*ProxyGroup {
+	groups := make([]*ProxyGroup, 0, len(sourceGroups))
+	seen := make(map[string]bool)
+	for _, sg := range sourceGroups {
+		if seen[sg.name] {
+			log.Warnln("proxy group %s from %s is ignored, it is already defined", sg.name, sg.source)
+			continue
+		}
+		seen[sg.name] = true
+
+		group := &ProxyGroup{
+			Name:   sg.name,
+			Config: sg.config,
+			Source: sg.source,
+		}
+		members := make(map[string]bool)
+		for _, item := range sg.items {
+			if item.proxy == nil {
+				if !members[item.group] {
+					members[item.group] = true
+					group.Members = append(group.Members, item.group)
+					group.Groups = append(group.Groups, item.group)
+				}
+				continue
+			}
+			name, ok := finalNames[item.proxy]
+			if !ok || proxies[name] == nil || members[name] {
+				continue
+			}
+			members[name] = true
+			group.Members = append(group.Members, name)
+			group.Proxies = append(group.Proxies, name)
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// GroupMembers 返回策略组及其嵌套策略组中的全部节点名称
+func GroupMembers(groups []*ProxyGroup, name string) ([]string, error) {
+	index := make(map[string]*ProxyGroup, len(groups))
+	for _, group := range groups {
+		index[group.Name] = group
+	}
+	if index[name] == nil {
+		return nil, fmt.Errorf("proxy group %s not found", name)
+	}
+
+	var members []string
+	seen := make(map[string]bool)
+	visited := make(map[string]bool)
+	var walk func(group *ProxyGroup)
+	walk = func(group *ProxyGroup) {
+		if visited[group.Name] {
+			return
+		}
+		visited[group.Name] = true
+		for _, proxy := range group.Proxies {
+			if !seen[proxy] {
+				seen[proxy] = true
+				members = append(members, proxy)
+			}
+		}
+		for _, nested := range group.Groups {
+			if index[nested] != nil {
+				walk(index[nested])
+			}
+		}
+	}
+	walk(index[name])
+	return members, nil
+}
+
+// SubGroups 返回策略组及其嵌套的策略组，name 为空时返回全部策略组
+func SubGroups(groups []*ProxyGroup, name string) []*ProxyGroup {
+	if name == "" {
+		return groups
+	}
+	index := make(map[string]*ProxyGroup, len(groups))
+	for _, group := range groups {
+		index[group.Name] = group
+	}
+	selected := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		group := index[name]
+		if group == nil || selected[name] {
+			return
+		}
+		selected[name] = true
+		for _, nested := range group.Groups {
+			walk(nested)
+		}
+	}
+	walk(name)
+
+	result := make([]*ProxyGroup, 0, len(selected))
+	for _, group := range groups {
+		if selected[group.Name] {
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// BuildGroupConfigs 生成输出配置中的 proxy-groups，names 为输出节点的测试名称到输出名称的映射，
+// 没有任何成员的策略组会被移除，引用它的策略组也会同时移除这个引用
+func BuildGroupConfigs(groups []*ProxyGroup, names map[string]string) []map[string]any {
+	kept := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		kept[group.Name] = true
+	}
+
+	members := make(map[string][]string, len(groups))
+	for changed := true; changed; {
+		changed = false
+		for _, group := range groups {
+			if !kept[group.Name] {
+				continue
+			}
+			nested := make(map[string]bool, len(group.Groups))
+			for _, name := range group.Groups {
+				nested[name] = true
+			}
+			list := make([]string, 0, len(group.Members))
+			for _, member := range group.Members {
+				if nested[member] {
+					if kept[member] || builtinPolicies[member] {
+						list = append(list, member)
+					}
+				} else if name, ok := names[member]; ok {
+					list = append(list, name)
+				}
+			}
+			// relay 策略组缺少任何一跳都会改变链路，整个策略组不输出
+			if len(list) == 0 || (group.Config["type"] == "relay" && len(list) != len(group.Members)) {
+				kept[group.Name] = false
+				changed = true
+				continue
+			}
+			members[group.Name] = list
+		}
+	}
+
+	configs := make([]map[string]any, 0, len(groups))
+	for _, group := range groups {
+		if !kept[group.Name] {
+			continue
+		}
+		config := make(map[string]any, len(group.Config))
+		for key, value := range group.Config {
+			switch key {
+			// 成员已经展开成 proxies，去掉引用 provider 和过滤相关的选项
+			case "use", "include-all", "include-all-proxies", "include-all-providers",
+				"filter", "exclude-filter", "exclude-type":
+			default:
+				config[key] = value
+			}
+		}
+		config["proxies"] = members[group.Name]
+		configs = append(configs, config)
+	}
+	return configs
+}
@@ -0,0 +1,234 @@
+package speedtester
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/inbound"
+	"github.com/metacubex/mihomo/constant"
+	authStore "github.com/metacubex/mihomo/listener/auth"
+	LC "github.com/metacubex/mihomo/listener/config"
+	httpListener "github.com/metacubex/mihomo/listener/http"
+	"github.com/metacubex/mihomo/listener/sing_shadowsocks"
+	"github.com/metacubex/mihomo/listener/socks"
+	"gopkg.in/yaml.v3"
+)
+
+// startDownloadServer 启动本地的 download-server，返回它的地址
+func startDownloadServer(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(NewDownloadServer())
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// directTunnel 入站连接直接连接目标地址，本地的 SOCKS5、HTTP 和 Shadowsocks 服务端使用它转发，
+// conns 不为空时记录转发的连接数
+type directTunnel struct {
+	conns *atomic.Int32
+}
+
+func (d directTunnel) HandleTCPConn(conn net.Conn, metadata *constant.Metadata) {
+	defer conn.Close()
+	if d.conns != nil {
+		d.conns.Add(1)
+	}
+	remote, err := net.DialTimeout("tcp", metadata.RemoteAddress(), 5*time.Second)
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	io.Copy(conn, remote)
+	conn.Close()
+	<-done
+}
+
+func (directTunnel) HandleUDPPacket(packet constant.UDPPacket, metadata *constant.Metadata) {
+	packet.Drop()
+}
+
+func (directTunnel) NatTable() constant.NatTable {
+	return nil
+}
+
+// localServer 监听本地随机端口，不使用默认的认证和局域网访问控制
+func localServer() LC.AuthServer {
+	return LC.AuthServer{Enable: true, Listen: "127.0.0.1:0", AuthStore: authStore.Nil}
+}
+
+// startSocks5 启动本地的 SOCKS5 服务端，返回节点配置
+func startSocks5(t *testing.T, name string) map[string]any {
+	t.Helper()
+	return startCountingSocks5(t, name, nil)
+}
+
+// startCountingSocks5 启动本地的 SOCKS5 服务端，conns 记录经过它的连接数
+func startCountingSocks5(t *testing.T, name string, conns *atomic.Int32) map[string]any {
+	t.Helper()
+	listener, err := socks.NewWithConfig(localServer(), directTunnel{conns: conns}, inbound.WithInName("test-socks"))
+	if err != nil {
+		t.Fatalf("start socks5 listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return proxyConfig(t, name, "socks5", listener.Address(), nil)
+}
+
+// startHTTPProxy 启动本地的 HTTP 代理服务端，返回节点配置
+func startHTTPProxy(t *testing.T, name string) map[string]any {
+	t.Helper()
+	listener, err := httpListener.NewWithConfig(localServer(), directTunnel{}, inbound.WithInName("test-http"))
+	if err != nil {
+		t.Fatalf("start http listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return proxyConfig(t, name, "http", listener.Address(), nil)
+}
+
+// startShadowsocks 启动本地的 Shadowsocks 服务端，返回节点配置
+func startShadowsocks(t *testing.T, name, cipher, password string) map[string]any {
+	t.Helper()
+	listener, err := sing_shadowsocks.New(LC.ShadowsocksServer{
+		Enable:   true,
+		Listen:   "127.0.0.1:0",
+		Cipher:   cipher,
+		Password: password,
+	}, directTunnel{}, inbound.WithInName("test-shadowsocks"))
+	if err != nil {
+		t.Fatalf("start shadowsocks listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return proxyConfig(t, name, "ss", listener.AddrList()[0].String(), map[string]any{
+		"cipher":   cipher,
+		"password": password,
+	})
+}
+
+func proxyConfig(t *testing.T, name, proxyType, address string, extra map[string]any) map[string]any {
+	t.Helper()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatalf("split listener address %s: %v", address, err)
+	}
+	config := map[string]any{"name": name, "type": proxyType, "server": host, "port": port}
+	for key, value := range extra {
+		config[key] = value
+	}
+	return config
+}
+
+// writeConfig 把节点写入临时的 YAML 配置文件，返回文件路径
+func writeConfig(t *testing.T, config *RawConfig) string {
+	t.Helper()
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+// fakeProxy 在内存中模拟的节点，直接连接目标地址，可以设置延迟、带宽和注入错误
+type fakeProxy struct {
+	constant.Proxy
+	// latency 每次请求往返额外增加的延迟，bandwidth 为每个连接每秒读取的字节数，0 表示不限制
+	latency   time.Duration
+	bandwidth int
+	// connBandwidth 不为空时按连接的目标地址决定这个连接的带宽，返回 0 时使用 bandwidth
+	connBandwidth func(metadata *constant.Metadata) int
+	// failDials 前 failDials 次拨号失败，resetAfter 大于 0 时每个连接读取这么多字节后被重置
+	failDials  int32
+	resetAfter int64
+
+	dials atomic.Int32
+}
+
+func newFakeProxy(t *testing.T, name string) *fakeProxy {
+	t.Helper()
+	direct, err := adapter.ParseProxy(map[string]any{"name": name, "type": "direct"})
+	if err != nil {
+		t.Fatalf("parse direct proxy: %v", err)
+	}
+	return &fakeProxy{Proxy: direct}
+}
+
+// cproxy 返回可以直接交给 testProxy 的节点
+func (p *fakeProxy) cproxy() *CProxy {
+	return &CProxy{Proxy: p, Config: map[string]any{"name": p.Name(), "type": "direct"}}
+}
+
+func (p *fakeProxy) DialContext(ctx context.Context, metadata *constant.Metadata) (constant.Conn, error) {
+	if p.dials.Add(1) <= p.failDials {
+		return nil, errors.New("injected dial failure")
+	}
+	conn, err := p.Proxy.DialContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	bandwidth := p.bandwidth
+	if p.connBandwidth != nil {
+		if b := p.connBandwidth(metadata); b > 0 {
+			bandwidth = b
+		}
+	}
+	return &shapedConn{Conn: conn, proxy: p, bandwidth: bandwidth, start: time.Now()}, nil
+}
+
+// shapedConn 按 fakeProxy 的设置延迟、限速和重置连接
+type shapedConn struct {
+	constant.Conn
+	proxy     *fakeProxy
+	bandwidth int
+	// wrote 写入了请求，读到响应时等待 latency 模拟一次往返
+	wrote atomic.Bool
+	// start 和 read 为当前响应开始读取的时间和字节数，total 为连接读取的总字节数
+	start time.Time
+	read  int64
+	total int64
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	c.wrote.Store(true)
+	return c.Conn.Write(b)
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	if resetAfter := c.proxy.resetAfter; resetAfter > 0 {
+		if c.total >= resetAfter {
+			c.Conn.Close()
+			return 0, syscall.ECONNRESET
+		}
+		b = b[:min(int64(len(b)), resetAfter-c.total)]
+	}
+	n, err := c.Conn.Read(b)
+	// 读取在写入请求之前就已经开始等待，写入之后读到的第一块数据是响应的开始
+	if c.wrote.Swap(false) {
+		time.Sleep(c.proxy.latency)
+		c.start = time.Now()
+		c.read = 0
+	}
+	c.read += int64(n)
+	c.total += int64(n)
+	if bandwidth := c.bandwidth; bandwidth > 0 {
+		expected := time.Duration(float64(c.read) / float64(bandwidth) * float64(time.Second))
+		time.Sleep(expected - time.Since(c.start))
+	}
+	return n, err
+}
@@ -0,0 +1,133 @@
+package speedtester
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// holdURL 长连接测试的 echo 地址，没有设置 HoldURL 时只有第一个测试目标是 download-server 才使用它的 /__echo
+func (st *SpeedTester) holdURL() string {
+	if st.config.HoldURL != "" {
+		return st.config.HoldURL
+	}
+	if target := st.targets()[0]; target.Protocol == ProtocolDownloadServer {
+		return target.baseURL() + "/__echo"
+	}
+	return ""
+}
+
+type holdResult struct {
+	// survived 连接保持的时间，reset 表示连接被对端关闭或重置，err 为断开的原因
+	survived time.Duration
+	reset    bool
+	err      error
+}
+
+// testHold 通过节点连接 echo 地址，每隔 HoldIdle 发送一小段数据并等待返回，直到连接断开或者达到 HoldDuration。
+// 拨号、TLS 握手和 Upgrade 失败时返回 error，连接建立之后断开的原因记录在 holdResult 中
+func (st *SpeedTester) testHold(proxy constant.Proxy, rawURL string) (*holdResult, error) {
+	conn, reader, err := st.dialEcho(proxy, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	payload := make([]byte, 16)
+	echo := make([]byte, len(payload))
+	for seq := 0; ; seq++ {
+		remaining := st.config.HoldDuration - time.Since(start)
+		if remaining <= 0 {
+			return &holdResult{survived: time.Since(start)}, nil
+		}
+		time.Sleep(min(st.config.HoldIdle, remaining))
+
+		copy(payload, fmt.Sprintf("%016d", seq))
+		conn.SetDeadline(time.Now().Add(st.config.Timeout))
+		if _, err = conn.Write(payload); err == nil {
+			_, err = io.ReadFull(reader, echo)
+		}
+		if err == nil && !bytes.Equal(payload, echo) {
+			err = errors.New("echo mismatch")
+		}
+		if err != nil {
+			var netErr net.Error
+			reset := !(errors.As(err, &netErr) && netErr.Timeout())
+			return &holdResult{survived: time.Since(start), reset: reset, err: err}, nil
+		}
+	}
+}
+
+// dialEcho 建立连接并通过 Upgrade: echo 请求切换到 echo 模式
+func (st *SpeedTester) dialEcho(proxy constant.Proxy, rawURL string) (net.Conn, *bufio.Reader, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), st.config.Timeout)
+	defer cancel()
+	var conn net.Conn
+	conn, err = proxy.DialContext(ctx, &constant.Metadata{
+		Host:    u.Hostname(),
+		DstPort: uint16(portInt),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	conn.SetDeadline(time.Now().Add(st.config.Timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return conn, reader, nil
+}
@@ -0,0 +1,91 @@
+package speedtester
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// probeLatency 发送一次延迟测试请求，返回收到响应头的时间和协商的协议，被限流时返回 errThrottled
+func (st *SpeedTester) probeLatency(client *http.Client, probe latencyProbe) (time.Duration, string, error) {
+	resp, start, err := st.do(client, func() (*http.Request, error) {
+		return http.NewRequest(probe.method, probe.url, nil)
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	latency := time.Since(start)
+	// 读完响应体才能复用连接，否则复用连接的延迟测试每次都会新建连接
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	// health-check 地址通常返回 204
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return 0, "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return latency, resp.Proto, nil
+}
+
+// testColdLatency 每个请求都使用新的连接，延迟包含节点握手和 TLS 握手的时间
+func (st *SpeedTester) testColdLatency(proxy constant.Proxy, probe latencyProbe, timeout time.Duration) *latencyResult {
+	if st.config.LatencyTimeout > 0 {
+		timeout = st.config.LatencyTimeout
+	}
+	latencies := make([]time.Duration, 0, st.config.LatencyCount)
+	failedPings, throttledPings := 0, 0
+	for i := 0; i < st.config.LatencyCount; i++ {
+		time.Sleep(st.config.LatencyInterval)
+
+		client := st.createClient(proxy, timeout)
+		latency, _, err := st.probeLatency(client, probe)
+		client.CloseIdleConnections()
+		switch {
+		case err == nil:
+			latencies = append(latencies, latency)
+		case errors.Is(err, errThrottled):
+			throttledPings++
+		default:
+			failedPings++
+		}
+	}
+	result := calculateLatencyStats(latencies, failedPings)
+	result.throttled = throttledPings > 0
+	return result
+}
+
+// testWarmLatency 先建立一个连接，之后的请求都复用这个连接，延迟只包含往返时间
+func (st *SpeedTester) testWarmLatency(proxy constant.Proxy, probe latencyProbe, timeout time.Duration) *latencyResult {
+	if st.config.LatencyTimeout > 0 {
+		timeout = st.config.LatencyTimeout
+	}
+	client := st.createClient(proxy, timeout)
+	defer client.CloseIdleConnections()
+	if _, _, err := st.probeLatency(client, probe); err != nil {
+		if errors.Is(err, errThrottled) {
+			return &latencyResult{throttled: true}
+		}
+		return calculateLatencyStats(nil, st.config.LatencyCount)
+	}
+
+	latencies := make([]time.Duration, 0, st.config.LatencyCount)
+	failedPings, throttledPings := 0, 0
+	for i := 0; i < st.config.LatencyCount; i++ {
+		time.Sleep(st.config.LatencyInterval)
+
+		latency, _, err := st.probeLatency(client, probe)
+		switch {
+		case err == nil:
+			latencies = append(latencies, latency)
+		case errors.Is(err, errThrottled):
+			throttledPings++
+		default:
+			failedPings++
+		}
+	}
+	result := calculateLatencyStats(latencies, failedPings)
+	result.throttled = throttledPings > 0
+	return result
+}
@@ -0,0 +1,289 @@
+package speedtester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// PhaseHops 代理链逐跳测试延迟的阶段，用量计入 latency
+const PhaseHops = "hops"
+
+// ErrSkipPhases 阶段返回它时不再执行这个节点剩余的阶段
+var ErrSkipPhases = errors.New("skip remaining phases")
+
+// Phase 对单个节点的一个测试阶段，Config.Phases 中的阶段按顺序对每个节点执行，
+// Run 把结果写入 result，返回的错误记录在 result.PhaseErrors 中，返回 ErrSkipPhases 时跳过剩余的阶段
+type Phase interface {
+	Name() string
+	Run(ctx context.Context, proxy constant.Proxy, result *Result) error
+}
+
+// 内置的测试阶段，只能由 SpeedTester 通过 Config.Phases 执行，可以被自定义阶段包装后调用 Run，
+// 通过传入的 proxy 连接。download、upload、websocket 和 hold 只测试 latency 阶段中可用的节点
+var (
+	// LatencyPhase 测试每个目标的延迟、抖动、丢包以及新建连接和复用连接的延迟，节点不可用时跳过这个目标后续的下载和上传
+	LatencyPhase Phase = latencyPhase{}
+	// DownloadPhase 按预算测试每个目标的下载速度和下载期间的延迟，速度低于 MinDownloadSpeed 时跳过上传
+	DownloadPhase Phase = downloadPhase{}
+	// UploadPhase 测试每个目标的上传速度和上传期间的延迟
+	UploadPhase Phase = uploadPhase{}
+	// WebSocketPhase 设置了 WebSocket 时测试握手时间、消息往返时间和吞吐量
+	WebSocketPhase Phase = webSocketPhase{}
+	// HoldPhase 设置了 HoldDuration 时进行长连接测试
+	HoldPhase Phase = holdPhase{}
+	// HopsPhase 代理链逐跳测试延迟
+	HopsPhase Phase = hopsPhase{}
+)
+
+// DefaultPhases 没有设置 Config.Phases 时使用的阶段
+func DefaultPhases() []Phase {
+	return []Phase{LatencyPhase, DownloadPhase, UploadPhase, WebSocketPhase, HoldPhase, HopsPhase}
+}
+
+// ParsePhases 解析逗号分隔的内置阶段名称，例如 "latency,download"，
+// download、upload、websocket 和 hold 需要排在 latency 之后
+func ParsePhases(value string) ([]Phase, error) {
+	builtins := make(map[string]Phase)
+	for _, phase := range DefaultPhases() {
+		builtins[phase.Name()] = phase
+	}
+	var phases []Phase
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		phase, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid phase %q, expected latency, download, upload, websocket, hold or hops", name)
+		}
+		phases = append(phases, phase)
+	}
+	if err := validatePhases(phases); err != nil {
+		return nil, err
+	}
+	return phases, nil
+}
+
+// validatePhases 检查依赖延迟测试结果的内置阶段是否排在 latency 之后
+func validatePhases(phases []Phase) error {
+	latency := false
+	for _, phase := range phases {
+		switch phase.(type) {
+		case latencyPhase:
+			latency = true
+		case downloadPhase, uploadPhase, webSocketPhase, holdPhase:
+			if !latency {
+				return fmt.Errorf("phase %s requires latency before it", phase.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// phases 返回测试阶段，没有设置 Config.Phases 时使用 DefaultPhases
+func (st *SpeedTester) phases() []Phase {
+	if len(st.config.Phases) > 0 {
+		return st.config.Phases
+	}
+	return DefaultPhases()
+}
+
+// nodeTest 同一个节点的各个阶段之间共享的状态
+type nodeTest struct {
+	st      *SpeedTester
+	name    string
+	proxy   *CProxy
+	emit    emitter
+	targets []*targetTest
+}
+
+// targetTest 节点对单个测试目标的状态，第一个目标的结果同时作为节点的主要结果
+type targetTest struct {
+	target Target
+	probe  latencyProbe
+	result *TargetResult
+	// measured 为 true 时已经进行了延迟测试，stopped 节点对这个目标不可用或速度低于下限，不再进行下载和上传测试
+	measured bool
+	stopped  bool
+	// planned 为 true 时已经按预算决定了下载和上传大小
+	planned      bool
+	downloadSize int
+	uploadSize   int
+}
+
+func (st *SpeedTester) newNodeTest(name string, proxy *CProxy, emit emitter) *nodeTest {
+	node := &nodeTest{st: st, name: name, proxy: proxy, emit: emit}
+	for i, target := range st.targets() {
+		probe := target.latencyProbe()
+		// provider 的 health-check 地址只用于第一个目标
+		if i == 0 && proxy.LatencyURL != "" {
+			probe = latencyProbe{url: proxy.LatencyURL, method: http.MethodGet}
+		}
+		node.targets = append(node.targets, &targetTest{
+			target: target,
+			probe:  probe,
+			result: &TargetResult{Name: target.Name},
+		})
+	}
+	return node
+}
+
+// startPhase 开始节点的一个测试阶段，事件发送到这次运行的 emitter
+func (node *nodeTest) startPhase(phase string) *phaseTracker {
+	return node.st.startPhase(node.emit, node.name, phase)
+}
+
+// plan 按剩余预算决定下载和上传大小，每个目标只计算一次
+func (t *targetTest) plan(st *SpeedTester) {
+	if t.planned {
+		return
+	}
+	t.planned = true
+	t.downloadSize, t.uploadSize, t.result.Budget = st.throughputPlan(t.result.Latency, t.target.uploadURL() != "")
+}
+
+// available 节点对这个目标通过了延迟测试，可以进行下载和上传测试
+func (t *targetTest) available() bool {
+	return t.measured && !t.stopped
+}
+
+// available 节点对第一个目标通过了延迟测试，可以进行 WebSocket 和长连接测试
+func (node *nodeTest) available() bool {
+	first := node.targets[0]
+	return first.measured && first.result.PacketLoss < 100 && first.result.Latency > 0
+}
+
+// sync 把第一个目标的结果复制到节点的结果
+func (node *nodeTest) sync(result *Result) {
+	first := node.targets[0].result
+	result.Latency = first.Latency
+	result.Jitter = first.Jitter
+	result.PacketLoss = first.PacketLoss
+	result.DownloadSize = first.DownloadSize
+	result.DownloadTime = first.DownloadTime
+	result.DownloadSpeed = first.DownloadSpeed
+	result.UploadSize = first.UploadSize
+	result.UploadTime = first.UploadTime
+	result.UploadSpeed = first.UploadSpeed
+	result.Protocol = first.Protocol
+	result.DownloadLatency = first.DownloadLatency
+	result.UploadLatency = first.UploadLatency
+	result.Bufferbloat = first.Bufferbloat
+	result.LatencyStats = first.LatencyStats
+	result.ColdLatency = first.ColdLatency
+	result.WarmLatency = first.WarmLatency
+	result.Throttled = first.Throttled
+	result.Attempts = first.Attempts
+	result.Budget = first.Budget
+}
+
+// errBuiltinPhase 在 SpeedTester 之外调用内置阶段的 Run 时返回，此时 result 中没有节点的测试状态
+var errBuiltinPhase = errors.New("builtin phase must be run by SpeedTester through Config.Phases")
+
+// nodeOf 返回 testProxy 保存在 result 中的节点测试状态
+func nodeOf(result *Result) (*nodeTest, error) {
+	if result.node == nil {
+		return nil, errBuiltinPhase
+	}
+	return result.node, nil
+}
+
+// isBuiltinPhase 内置阶段自己记录用量，testProxy 只为自定义阶段记录时间
+func isBuiltinPhase(phase Phase) bool {
+	switch phase.(type) {
+	case latencyPhase, downloadPhase, uploadPhase, webSocketPhase, holdPhase, hopsPhase:
+		return true
+	}
+	return false
+}
+
+type latencyPhase struct{}
+
+func (latencyPhase) Name() string { return PhaseLatency }
+
+func (latencyPhase) Run(ctx context.Context, proxy constant.Proxy, result *Result) error {
+	node, err := nodeOf(result)
+	if err != nil {
+		return err
+	}
+	for _, t := range node.targets {
+		node.st.testTargetLatency(ctx, node, proxy, t)
+	}
+	node.sync(result)
+	return nil
+}
+
+type downloadPhase struct{}
+
+func (downloadPhase) Name() string { return PhaseDownload }
+
+func (downloadPhase) Run(ctx context.Context, proxy constant.Proxy, result *Result) error {
+	node, err := nodeOf(result)
+	if err != nil {
+		return err
+	}
+	for _, t := range node.targets {
+		node.st.testTargetDownload(ctx, node, proxy, t)
+	}
+	node.sync(result)
+	return nil
+}
+
+type uploadPhase struct{}
+
+func (uploadPhase) Name() string { return PhaseUpload }
+
+func (uploadPhase) Run(ctx context.Context, proxy constant.Proxy, result *Result) error {
+	node, err := nodeOf(result)
+	if err != nil {
+		return err
+	}
+	for _, t := range node.targets {
+		node.st.testTargetUpload(ctx, node, proxy, t)
+	}
+	node.sync(result)
+	return nil
+}
+
+type webSocketPhase struct{}
+
+func (webSocketPhase) Name() string { return PhaseWebSocket }
+
+func (webSocketPhase) Run(_ context.Context, proxy constant.Proxy, result *Result) error {
+	node, err := nodeOf(result)
+	if err != nil {
+		return err
+	}
+	node.st.testNodeWebSocket(node, proxy, result)
+	return nil
+}
+
+type holdPhase struct{}
+
+func (holdPhase) Name() string { return PhaseHold }
+
+func (holdPhase) Run(_ context.Context, proxy constant.Proxy, result *Result) error {
+	node, err := nodeOf(result)
+	if err != nil {
+		return err
+	}
+	node.st.testNodeHold(node, proxy, result)
+	return nil
+}
+
+// hopsPhase 逐跳测试的是代理链中的前置节点，不使用传入的 proxy
+type hopsPhase struct{}
+
+func (hopsPhase) Name() string { return PhaseHops }
+
+func (hopsPhase) Run(_ context.Context, _ constant.Proxy, result *Result) error {
+	node, err := nodeOf(result)
+	if err != nil {
+		return err
+	}
+	node.st.testNodeHops(node, result)
+	return nil
+}
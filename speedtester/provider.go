@@ -0,0 +1,249 @@
+package speedtester
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/metacubex/mihomo/adapter/provider"
+	"github.com/metacubex/mihomo/common/convert"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"gopkg.in/yaml.v3"
+)
+
+// providerProxy provider 中的一个节点，config 是应用了 dialer-proxy 和 override 之后的配置
+type providerProxy struct {
+	proxy  constant.Proxy
+	config map[string]any
+}
+
+// loadProvider 读取 proxy-provider 中的节点配置，支持 http、file 和 inline 三种类型。
+// 内容由 speedtester 读取（http 类型经过 fetch proxy 和缓存），再构造成 inline provider 交给 mihomo
+// 处理 filter、exclude-filter、exclude-type 和 override，避免 mihomo 绕过 fetch proxy 再下载一次
+func (st *SpeedTester) loadProvider(configPath, name string, config map[string]any) ([]providerProxy, error) {
+	var payload []map[string]any
+	switch config["type"] {
+	case "http":
+		body, err := st.fetchProvider(configPath, name, config)
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = parseProviderBody(body); err != nil {
+			return nil, err
+		}
+	case "file":
+		path, _ := config["path"].(string)
+		if path == "" {
+			return nil, errors.New("file provider requires path")
+		}
+		// 相对路径以配置文件所在目录为准
+		if !filepath.IsAbs(path) && !strings.HasPrefix(configPath, "http") {
+			path = filepath.Join(filepath.Dir(configPath), path)
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = parseProviderBody(body); err != nil {
+			return nil, err
+		}
+	case "inline":
+		items, _ := config["payload"].([]any)
+		for _, item := range items {
+			if proxy, ok := item.(map[string]any); ok {
+				payload = append(payload, proxy)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported provider type: %v", config["type"])
+	}
+
+	// dialer-proxy 由 speedtester 建立代理链，不交给 mihomo
+	inline := map[string]any{"type": "inline", "payload": payload}
+	for key, value := range config {
+		switch key {
+		case "type", "url", "path", "interval", "proxy", "header", "size-limit", "payload", "dialer-proxy", "health-check":
+		default:
+			inline[key] = value
+		}
+	}
+	pd, err := provider.ParseProxyProvider(name, inline)
+	if err != nil {
+		return nil, err
+	}
+	// 不带 override 再解析一次得到原始名称，两次解析的过滤结果和顺序相同
+	delete(inline, "override")
+	origin, err := provider.ParseProxyProvider(name, inline)
+	if err != nil {
+		return nil, err
+	}
+	proxies, originProxies := pd.Proxies(), origin.Proxies()
+	if len(proxies) != len(originProxies) {
+		return nil, fmt.Errorf("provider %s resolved %d proxies, expected %d", name, len(proxies), len(originProxies))
+	}
+
+	configs := make(map[string]map[string]any, len(payload))
+	for _, proxy := range payload {
+		if name, ok := proxy["name"].(string); ok {
+			if _, exist := configs[name]; !exist {
+				configs[name] = proxy
+			}
+		}
+	}
+	dialerProxy, _ := config["dialer-proxy"].(string)
+	override, _ := config["override"].(map[string]any)
+	result := make([]providerProxy, 0, len(proxies))
+	for i, proxy := range proxies {
+		pdConfig := make(map[string]any)
+		for key, value := range configs[originProxies[i].Name()] {
+			pdConfig[key] = value
+		}
+		for key, value := range override {
+			switch key {
+			case "additional-prefix", "additional-suffix", "proxy-name":
+			default:
+				pdConfig[key] = value
+			}
+		}
+		if dialerProxy != "" {
+			pdConfig["dialer-proxy"] = dialerProxy
+		}
+		pdConfig["name"] = proxy.Name()
+		result = append(result, providerProxy{proxy: proxy, config: pdConfig})
+	}
+	return result, nil
+}
+
+// fetchProvider 下载 http provider，设置了缓存时优先使用未过期的缓存，下载失败时回退到过期的缓存。
+// 订阅信息和内容一起缓存，使用缓存时同样会报告订阅流量
+func (st *SpeedTester) fetchProvider(configPath, name string, config map[string]any) ([]byte, error) {
+	source := providerSource(config)
+	label := fmt.Sprintf("%s > %s", sourceLabel(configPath), name)
+	cachePath := st.providerCachePath(source.Path)
+	if cachePath != "" {
+		if stat, err := os.Stat(cachePath); err == nil && time.Since(stat.ModTime()) < st.config.ProviderCacheTTL {
+			if body, err := os.ReadFile(cachePath); err == nil {
+				st.addCachedSubscription(cachePath, label)
+				return body, nil
+			}
+		}
+	}
+
+	body, info, err := st.fetch(source)
+	if err != nil {
+		if cachePath != "" {
+			if cached, cacheErr := os.ReadFile(cachePath); cacheErr == nil {
+				log.Warnln("failed to fetch provider %s, use stale cache: %s", name, err)
+				st.addCachedSubscription(cachePath, label)
+				return cached, nil
+			}
+		}
+		return nil, err
+	}
+	if info != nil {
+		info.Source = label
+		st.subscriptions = append(st.subscriptions, info)
+	}
+	if cachePath != "" {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0o700); err == nil {
+			if err := os.WriteFile(cachePath, body, 0o600); err != nil {
+				log.Warnln("failed to write provider cache: %s", err)
+			}
+			writeCachedSubscription(cachePath, info)
+		}
+	}
+	return body, nil
+}
+
+// subscriptionCachePath 订阅信息的缓存文件，与 provider 内容放在一起
+func subscriptionCachePath(cachePath string) string {
+	return strings.TrimSuffix(cachePath, ".yaml") + ".info.json"
+}
+
+// writeCachedSubscription 缓存订阅信息，没有订阅信息时删除旧的缓存
+func writeCachedSubscription(cachePath string, info *SubscriptionInfo) {
+	path := subscriptionCachePath(cachePath)
+	if info == nil {
+		os.Remove(path)
+		return
+	}
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = os.WriteFile(path, data, 0o600)
+	}
+	if err != nil {
+		log.Warnln("failed to write provider cache: %s", err)
+	}
+}
+
+// addCachedSubscription 读取缓存的订阅信息并加入 Subscriptions
+func (st *SpeedTester) addCachedSubscription(cachePath, label string) {
+	data, err := os.ReadFile(subscriptionCachePath(cachePath))
+	if err != nil {
+		return
+	}
+	info := &SubscriptionInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return
+	}
+	info.Source = label
+	st.subscriptions = append(st.subscriptions, info)
+}
+
+// providerCachePath 缓存文件路径，未启用缓存时返回空字符串
+func (st *SpeedTester) providerCachePath(url string) string {
+	if st.config.ProviderCacheTTL <= 0 || url == "" {
+		return ""
+	}
+	dir := st.config.ProviderCacheDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(cacheDir, "clash-speedtest", "providers")
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x.yaml", sha256.Sum256([]byte(url))))
+}
+
+// parseProviderBody 解析 provider 内容，支持 Clash 配置和 V2Ray 分享链接
+func parseProviderBody(body []byte) ([]map[string]any, error) {
+	rawCfg := &RawConfig{}
+	yamlErr := yaml.Unmarshal(body, rawCfg)
+	if yamlErr == nil && rawCfg.Proxies != nil {
+		return rawCfg.Proxies, nil
+	}
+	proxies, err := convert.ConvertsV2Ray(body)
+	if err != nil {
+		if yamlErr != nil {
+			return nil, fmt.Errorf("%w, %w", yamlErr, err)
+		}
+		return nil, errors.New("file must have a `proxies` field")
+	}
+	return proxies, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerHealthCheckURL 返回 provider 的 health-check.url
+func providerHealthCheckURL(config map[string]any) string {
+	healthCheck, ok := config["health-check"].(map[string]any)
+	if !ok {
+		return ""
+	}
+	url, _ := healthCheck["url"].(string)
+	return url
+}
@@ -0,0 +1,112 @@
+package speedtester
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// errThrottled 测试目标返回 429 或 503，重试之后仍然被限流
+var errThrottled = errors.New("throttled by server")
+
+// newBandwidthLimiter 全局带宽限制，limit 为每秒字节数，0 表示不限制
+func newBandwidthLimiter(limit int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(limit), max(limit/10, 32*1024))
+}
+
+// requestLimiter 返回测试目标的请求频率限制，同一个 host 共用一个限制
+func (st *SpeedTester) requestLimiter(host string) *rate.Limiter {
+	if st.config.TargetRateLimit <= 0 {
+		return nil
+	}
+	st.limiterMu.Lock()
+	defer st.limiterMu.Unlock()
+	limiter, ok := st.requestLimiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(st.config.TargetRateLimit), 1)
+		st.requestLimiters[host] = limiter
+	}
+	return limiter
+}
+
+// do 发送请求，遵守测试目标的请求频率限制，收到 429 或 503 时按 Retry-After 退避重试，
+// newRequest 每次重试时重新创建请求，返回的 start 为最后一次请求的发送时间
+func (st *SpeedTester) do(client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, time.Time, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if limiter := st.requestLimiter(req.URL.Host); limiter != nil {
+			if err := limiter.Wait(req.Context()); err != nil {
+				return nil, time.Time{}, err
+			}
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, start, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			return resp, start, nil
+		}
+		resp.Body.Close()
+
+		wait := retryAfter(resp.Header.Get("Retry-After"), attempt)
+		if attempt >= st.config.ThrottleRetries || wait > st.config.ThrottleMaxWait {
+			return nil, start, errThrottled
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, start, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryAfter 解析 Retry-After 响应头，支持秒数和 HTTP 日期，没有时按 1s、2s、4s…… 退避
+func retryAfter(value string, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return time.Second << attempt
+}
+
+// limitReader 按全局带宽限制读取数据，ctx 为请求的 ctx，取消后不再等待带宽
+func (st *SpeedTester) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	if st.bandwidth == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: st.bandwidth}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > lr.limiter.Burst() {
+		p = p[:lr.limiter.Burst()]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if waitErr := lr.limiter.WaitN(lr.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
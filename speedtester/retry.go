@@ -0,0 +1,187 @@
+package speedtester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 可以设置重试策略的测试阶段
+const (
+	PhaseLatency  = "latency"
+	PhaseDownload = "download"
+	PhaseUpload   = "upload"
+	PhaseIPLookup = "ip-lookup"
+)
+
+// 可以重试的错误类型
+const (
+	// RetryDial 通过节点建立连接失败，即 Op 为 dial 的 *net.OpError
+	RetryDial = "dial"
+	// RetryTimeout 请求超时
+	RetryTimeout = "timeout"
+	// RetryReset 连接被重置或提前关闭
+	RetryReset = "reset"
+	// RetryStatus 测试目标返回 5xx，429 和 503 由限流处理
+	RetryStatus = "5xx"
+)
+
+// RetryPolicy 一个测试阶段的重试策略，Attempts 为最多尝试的次数，第 n 次重试前等待 Backoff*2^(n-1)，最多等待 maxRetryBackoff，
+// Retryable 为可以重试的错误类型，为空时重试 dial、timeout 和 reset
+type RetryPolicy struct {
+	Attempts  int
+	Backoff   time.Duration
+	Retryable []string
+}
+
+// ParseRetryPolicy 解析 "phase=attempts[,backoff[,class|class]]"，phase 为 all 时对所有阶段生效
+func ParseRetryPolicy(value string) (string, RetryPolicy, error) {
+	phase, spec, ok := strings.Cut(value, "=")
+	phase = strings.TrimSpace(phase)
+	if !ok || spec == "" {
+		return "", RetryPolicy{}, fmt.Errorf("invalid retry policy %q, expected phase=attempts[,backoff[,classes]]", value)
+	}
+	switch phase {
+	case "all", PhaseLatency, PhaseDownload, PhaseUpload, PhaseIPLookup:
+	default:
+		return "", RetryPolicy{}, fmt.Errorf("invalid retry phase %q, expected all, latency, download, upload or ip-lookup", phase)
+	}
+
+	parts := strings.Split(spec, ",")
+	policy := RetryPolicy{}
+	attempts, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || attempts < 1 {
+		return "", RetryPolicy{}, fmt.Errorf("invalid retry attempts %q", parts[0])
+	}
+	policy.Attempts = attempts
+	if len(parts) > 1 {
+		if policy.Backoff, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil {
+			return "", RetryPolicy{}, fmt.Errorf("invalid retry backoff %q: %w", parts[1], err)
+		}
+	}
+	if len(parts) > 2 {
+		for _, class := range strings.Split(parts[2], "|") {
+			class = strings.TrimSpace(class)
+			switch class {
+			case RetryDial, RetryTimeout, RetryReset, RetryStatus:
+				policy.Retryable = append(policy.Retryable, class)
+			default:
+				return "", RetryPolicy{}, fmt.Errorf("invalid retry error class %q, expected dial, timeout, reset or 5xx", class)
+			}
+		}
+	}
+	if len(parts) > 3 {
+		return "", RetryPolicy{}, fmt.Errorf("invalid retry policy %q, expected phase=attempts[,backoff[,classes]]", value)
+	}
+	return phase, policy, nil
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	class := errorClass(err)
+	if class == "" {
+		return false
+	}
+	if len(p.Retryable) == 0 {
+		return class != RetryStatus
+	}
+	for _, retryable := range p.Retryable {
+		if retryable == class {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicy 返回测试阶段的重试策略，没有设置时使用 all，都没有时只尝试一次
+func (st *SpeedTester) retryPolicy(phase string) RetryPolicy {
+	policy, ok := st.config.Retry[phase]
+	if !ok {
+		policy = st.config.Retry["all"]
+	}
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	return policy
+}
+
+// maxRetryBackoff 两次尝试之间最多等待的时间
+const maxRetryBackoff = time.Minute
+
+// Retry 按 phase 的重试策略执行 fn，返回实际尝试的次数和最后一次的错误，等待重试时 ctx 结束则不再重试
+func (st *SpeedTester) Retry(ctx context.Context, phase string, fn func() error) (int, error) {
+	policy := st.retryPolicy(phase)
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= policy.Attempts || !policy.retryable(err) {
+			return attempt, err
+		}
+		timer := time.NewTimer(retryBackoff(policy.Backoff, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryBackoff 第 attempt 次重试前等待的时间 backoff*2^(attempt-1)，超过 maxRetryBackoff 后不再翻倍，避免溢出
+func retryBackoff(backoff time.Duration, attempt int) time.Duration {
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
+// statusError 测试目标返回了意外的状态码
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status: " + e.status
+}
+
+// errorClass 返回错误的类型，无法归类时为空
+func errorClass(err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	var statusErr *statusError
+	switch {
+	case err == nil, errors.Is(err, errThrottled):
+		return ""
+	case errors.As(err, &statusErr):
+		if statusErr.code >= 500 {
+			return RetryStatus
+		}
+		return ""
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return RetryDial
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return RetryTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return RetryReset
+	}
+	return ""
+}
+
+// Attempts 每个测试阶段中单次测试最多尝试的次数，只记录需要重试的阶段
+type Attempts map[string]int
+
+// Record 记录 phase 的尝试次数，只尝试一次时不记录
+func (a *Attempts) Record(phase string, attempts int) {
+	if attempts <= 1 {
+		return
+	}
+	if *a == nil {
+		*a = make(Attempts)
+	}
+	(*a)[phase] = max((*a)[phase], attempts)
+}
@@ -2,6 +2,7 @@ package speedtester
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -9,15 +10,15 @@ import (
 	"net/http"
 	"os"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/metacubex/mihomo/adapter"
 	"github.com/metacubex/mihomo/adapter/provider"
 	"github.com/metacubex/mihomo/constant"
 	"github.com/metacubex/mihomo/log"
+	"golang.org/x/time/rate"
 	"gopkg.in/yaml.v3"
 )
 
@@ -34,12 +35,97 @@ type Config struct {
 	MinDownloadSpeed float64
 	MinUploadSpeed   float64
 	FastMode         bool
+	Sources          []Source
+	FetchUserAgent   string
+	FetchHeaders     map[string]string
+	FetchTimeout     time.Duration
+	FetchRetries     int
+	FetchProxy       string
+
+	ProviderCacheDir    string
+	ProviderCacheTTL    time.Duration
+	ProviderHealthCheck bool
+
+	Group string
+
+	// Transport 测试使用的 HTTP 协议：h1、h2 或 h3，默认为 h1
+	Transport string
+
+	// LatencyCount 每次延迟测试发送的请求数，LatencyInterval 为请求间隔，LatencyTimeout 为单个请求的超时，
+	// LatencySkipFirst 为 true 时忽略包含建立连接时间的第一个请求
+	LatencyCount     int
+	LatencyInterval  time.Duration
+	LatencyTimeout   time.Duration
+	LatencySkipFirst bool
+
+	// StabilityInterval 稳定性测试中延迟测试的间隔，StabilityTransferInterval 为下载测试的间隔，0 表示不进行下载测试
+	StabilityInterval         time.Duration
+	StabilityTransferInterval time.Duration
+	// StabilityConcurrent 稳定性测试中同时测试的节点数，0 表示同时测试所有节点，超出的节点等前面的节点测试完成后再开始
+	StabilityConcurrent int
+
+	// HoldDuration 大于 0 时进行长连接测试，连接 HoldURL 的 echo 地址并每隔 HoldIdle 发送一次数据，
+	// 没有设置 HoldURL 时使用第一个测试目标的 /__echo，第一个测试目标不是 download-server 时不测试
+	HoldDuration time.Duration
+	HoldIdle     time.Duration
+	HoldURL      string
+
+	// WebSocket 为 true 时进行 WebSocket 测试，WebSocketURL 为 echo 地址，没有设置时使用第一个测试目标的 /__ws，
+	// WebSocketSize 为吞吐量测试发送的总字节数
+	WebSocket     bool
+	WebSocketURL  string
+	WebSocketSize int
+
+	// Targets 测试目标列表，为空时使用 ServerURL，设置了 Targets 时忽略 DownloadURL 和 UploadURL
+	Targets []Target
+	// DownloadURL 不为空时 GET 这个地址测试下载速度，DownloadRange 为 true 时使用 Range 请求限制下载大小，
+	// 没有设置 UploadURL 时仍然使用 ServerURL 的上传接口
+	DownloadURL   string
+	DownloadRange bool
+	// UploadURL 不为空时以 UploadMethod（POST 或 PUT）上传到这个地址测试上传速度
+	UploadURL    string
+	UploadMethod string
+
+	// BandwidthLimit 所有测试共用的带宽上限（字节/秒），TargetRateLimit 为每个测试目标每秒的请求数，0 表示不限制
+	BandwidthLimit  int
+	TargetRateLimit float64
+	// ThrottleRetries 收到 429 或 503 后的重试次数，Retry-After 超过 ThrottleMaxWait 时不再等待
+	ThrottleRetries int
+	ThrottleMaxWait time.Duration
+
+	// Retry 每个测试阶段的重试策略，键为 latency、download、upload、ip-lookup 或 all
+	Retry map[string]RetryPolicy
+
+	// MaxTotalBytes 整次测试最多使用的流量，MaxDuration 为最长的测试时间，0 表示不限制，
+	// 预算不足时缩小下载和上传大小或跳过低优先级节点的下载和上传测试
+	MaxTotalBytes int64
+	MaxDuration   time.Duration
+
+	// Tiered 为 true 时分级测试：以 TieredConcurrent 并发测试所有节点的延迟，对可用节点下载 TieredProbeSize 字节，
+	// 只对小文件下载速度最快的 TieredTopK 个节点进行完整测试，快速模式下不生效。
+	// 前两步不按 Phases 执行，只有完整测试按 Phases 执行
+	Tiered           bool
+	TieredProbeSize  int
+	TieredTopK       int
+	TieredConcurrent int
+
+	// Phases 对每个节点按顺序执行的测试阶段，为空时使用 DefaultPhases，可以加入自定义的 Phase
+	Phases []Phase
 }
 
 type SpeedTester struct {
 	config           *Config
 	blockedNodes     []string
 	blockedNodeCount int
+	duplicates       []*DuplicateProxy
+	subscriptions    []*SubscriptionInfo
+	fetchProxy       constant.Proxy
+	groups           []*ProxyGroup
+
+	bandwidth       *rate.Limiter
+	limiterMu       sync.Mutex
+	requestLimiters map[string]*rate.Limiter
+	budget          *budget
 }
 
 func New(config *Config) *SpeedTester {
@@ -52,37 +138,97 @@ func New(config *Config) *SpeedTester {
 	if config.UploadSize < 0 {
 		config.UploadSize = 10 * 1024 * 1024
 	}
+	if config.FetchTimeout <= 0 {
+		config.FetchTimeout = 30 * time.Second
+	}
+	if config.FetchRetries < 0 {
+		config.FetchRetries = 0
+	}
+	if config.LatencyCount <= 0 {
+		config.LatencyCount = 6
+	}
+	if config.LatencyInterval <= 0 {
+		config.LatencyInterval = 100 * time.Millisecond
+	}
+	if config.WebSocketSize <= 0 {
+		config.WebSocketSize = 4 * 1024 * 1024
+	}
+	if config.HoldIdle <= 0 {
+		config.HoldIdle = 30 * time.Second
+	}
+	if config.StabilityInterval <= 0 {
+		config.StabilityInterval = 10 * time.Second
+	}
+	if config.ThrottleRetries < 0 {
+		config.ThrottleRetries = 0
+	}
+	if config.TieredProbeSize <= 0 {
+		config.TieredProbeSize = 2 * 1024 * 1024
+	}
+	if config.TieredTopK <= 0 {
+		config.TieredTopK = 10
+	}
+	if config.TieredConcurrent <= 0 {
+		config.TieredConcurrent = 16
+	}
+	if config.ThrottleMaxWait <= 0 {
+		config.ThrottleMaxWait = 30 * time.Second
+	}
 	return &SpeedTester{
-		config: config,
+		config:          config,
+		bandwidth:       newBandwidthLimiter(config.BandwidthLimit),
+		requestLimiters: make(map[string]*rate.Limiter),
+		budget:          newBudget(),
 	}
 }
 
 type CProxy struct {
 	constant.Proxy
 	Config map[string]any
+	Source string
+	// LatencyURL 不为空时代替 ServerURL 作为延迟测试的地址
+	LatencyURL string
+	// Chain 代理链中位于此节点之前的各跳，Chain[i] 是经过前 i+1 跳的代理
+	Chain []*CProxy
 }
 
 type RawConfig struct {
-	Providers map[string]map[string]any `yaml:"proxy-providers"`
-	Proxies   []map[string]any          `yaml:"proxies"`
+	Providers   map[string]map[string]any `yaml:"proxy-providers"`
+	Proxies     []map[string]any          `yaml:"proxies"`
+	ProxyGroups []map[string]any          `yaml:"proxy-groups,omitempty"`
 }
 
 func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, error) {
 	allProxies := make(map[string]*CProxy)
 	st.blockedNodes = make([]string, 0)
 	st.blockedNodeCount = 0
+	st.duplicates = make([]*DuplicateProxy, 0)
+	fingerprints := make(map[string]string)
+	duplicates := make(map[string]*DuplicateProxy)
+	st.subscriptions = make([]*SubscriptionInfo, 0)
+	sourceGroups := make([]*sourceGroup, 0)
+	finalNames := make(map[*CProxy]string)
+
+	fetchProxy, err := st.resolveFetchProxy()
+	if err != nil {
+		return nil, err
+	}
+	st.fetchProxy = fetchProxy
 
-	for _, configPath := range strings.Split(st.config.ConfigPaths, ",") {
+	for _, source := range st.sources() {
+		configPath := source.Path
 		var body []byte
 		var err error
 		if strings.HasPrefix(configPath, "http") {
-			var resp *http.Response
-			resp, err = http.Get(configPath)
+			var info *SubscriptionInfo
+			body, info, err = st.fetch(source)
 			if err != nil {
 				log.Warnln("failed to fetch config: %s", err)
 				continue
 			}
-			body, err = io.ReadAll(resp.Body)
+			if info != nil {
+				st.subscriptions = append(st.subscriptions, info)
+			}
 		} else {
 			body, err = os.ReadFile(configPath)
 		}
@@ -100,9 +246,12 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 		proxies := make(map[string]*CProxy)
 		proxiesConfig := rawCfg.Proxies
 		providersConfig := rawCfg.Providers
+		localOrder := make([]string, 0, len(proxiesConfig))
+		localProxies := make(map[string]*CProxy, len(proxiesConfig))
+		providerProxies := make(map[string][]*CProxy)
 
 		for i, config := range proxiesConfig {
-			proxy, err := adapter.ParseProxy(config)
+			proxy, err := parseProxy(config)
 			if err != nil {
 				return nil, fmt.Errorf("proxy %d: %w", i, err)
 			}
@@ -110,51 +259,69 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 			if _, exist := proxies[proxy.Name()]; exist {
 				return nil, fmt.Errorf("proxy %s is the duplicate name", proxy.Name())
 			}
-			proxies[proxy.Name()] = &CProxy{Proxy: proxy, Config: config}
+			proxies[proxy.Name()] = &CProxy{Proxy: proxy, Config: config, Source: sourceLabel(configPath)}
+			localProxies[proxy.Name()] = proxies[proxy.Name()]
+			localOrder = append(localOrder, proxy.Name())
 		}
 		for name, config := range providersConfig {
 			if name == provider.ReservedName {
 				return nil, fmt.Errorf("can not defined a provider called `%s`", provider.ReservedName)
 			}
-			pd, err := provider.ParseProxyProvider(name, config)
-			if err != nil {
-				return nil, fmt.Errorf("parse proxy provider %s error: %w", name, err)
-			}
-			if err := pd.Initial(); err != nil {
-				return nil, fmt.Errorf("initial proxy provider %s error: %w", pd.Name(), err)
-			}
 
-			resp, err := http.Get(config["url"].(string))
+			pdProxies, err := st.loadProvider(configPath, name, config)
 			if err != nil {
-				log.Warnln("failed to fetch config: %s", err)
+				log.Warnln("failed to load proxy provider %s: %s", name, err)
 				continue
 			}
-			body, err = io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, err
-			}
-			pdRawCfg := &RawConfig{
-				Proxies: []map[string]any{},
+			var latencyURL string
+			if st.config.ProviderHealthCheck {
+				latencyURL = providerHealthCheckURL(config)
 			}
-			if err := yaml.Unmarshal(body, pdRawCfg); err != nil {
-				return nil, err
+			for i, pdProxy := range pdProxies {
+				proxy := pdProxy.proxy
+				// 节点自身设置了 dialer-proxy 时 mihomo 会按名称查找前置节点，去掉后重新解析
+				if _, ok := pdProxy.config["dialer-proxy"]; ok {
+					if proxy, err = parseProxy(pdProxy.config); err != nil {
+						return nil, fmt.Errorf("proxy provider %s proxy %d: %w", name, i, err)
+					}
+				}
+				cproxy := &CProxy{
+					Proxy:      proxy,
+					Config:     pdProxy.config,
+					Source:     fmt.Sprintf("%s > %s", sourceLabel(configPath), name),
+					LatencyURL: latencyURL,
+				}
+				proxies[fmt.Sprintf("[%s] %s", name, proxy.Name())] = cproxy
+				providerProxies[name] = append(providerProxies[name], cproxy)
 			}
-			pdProxies := make(map[string]map[string]any)
-			for _, pdProxy := range pdRawCfg.Proxies {
-				pdProxies[pdProxy["name"].(string)] = pdProxy
+		}
+
+		var groups []*sourceGroup
+		if len(rawCfg.ProxyGroups) > 0 {
+			providerOrder := make([]string, 0, len(providerProxies))
+			for name := range providerProxies {
+				providerOrder = append(providerOrder, name)
 			}
-			for _, proxy := range pd.Proxies() {
-				proxies[fmt.Sprintf("[%s] %s", name, proxy.Name())] = &CProxy{
-					Proxy:  proxy,
-					Config: pdProxies[proxy.Name()],
-				}
+			sort.Strings(providerOrder)
+			groups, err = resolveGroups(rawCfg.ProxyGroups, localProxies, localOrder, providerProxies, providerOrder, sourceLabel(configPath))
+			if err != nil {
+				return nil, err
 			}
+			sourceGroups = append(sourceGroups, groups...)
+		}
+		linkChains(proxies, localProxies, groups)
+
+		names := make([]string, 0, len(proxies))
+		for k := range proxies {
+			names = append(names, k)
 		}
-		for k, p := range proxies {
+		sort.Strings(names)
+		for _, k := range names {
+			p := proxies[k]
 			switch p.Type() {
 			case constant.Shadowsocks, constant.ShadowsocksR, constant.Snell, constant.Socks5, constant.Http,
 				constant.Vmess, constant.Vless, constant.Trojan, constant.Hysteria, constant.Hysteria2,
-				constant.WireGuard, constant.Tuic, constant.Ssh, constant.Mieru, constant.AnyTLS:
+				constant.WireGuard, constant.Tuic, constant.Ssh, constant.Mieru, constant.AnyTLS, constant.Relay:
 			default:
 				continue
 			}
@@ -164,9 +331,38 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 			if stashCompatible && !isStashCompatible(p) {
 				continue
 			}
-			if _, ok := allProxies[k]; !ok {
-				allProxies[k] = p
+
+			// 同一服务器只测试一次，记录它出现在哪些来源中
+			fingerprint := p.Fingerprint()
+			if kept, ok := fingerprints[fingerprint]; ok {
+				duplicate, ok := duplicates[fingerprint]
+				if !ok {
+					duplicate = &DuplicateProxy{
+						Name:        kept,
+						Fingerprint: fingerprint,
+						Names:       []string{kept},
+						Sources:     []string{allProxies[kept].Source},
+					}
+					duplicates[fingerprint] = duplicate
+					st.duplicates = append(st.duplicates, duplicate)
+				}
+				duplicate.Names = append(duplicate.Names, k)
+				duplicate.Sources = append(duplicate.Sources, p.Source)
+				finalNames[p] = kept
+				continue
+			}
+
+			// 不同服务器使用了相同的名称时，为后出现的节点加上序号
+			name := k
+			for i := 2; allProxies[name] != nil; i++ {
+				name = fmt.Sprintf("%s #%d", k, i)
 			}
+			if name != k && p.Config != nil {
+				p.Config["name"] = name
+			}
+			fingerprints[fingerprint] = name
+			finalNames[p] = name
+			allProxies[name] = p
 		}
 	}
 
@@ -201,9 +397,50 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 			filteredProxies[name] = allProxies[name]
 		}
 	}
+
+	st.groups = finalizeGroups(sourceGroups, finalNames, allProxies)
+	if st.config.Group != "" {
+		members, err := GroupMembers(st.groups, st.config.Group)
+		if err != nil {
+			return nil, err
+		}
+		groupProxies := make(map[string]*CProxy, len(members))
+		for _, name := range members {
+			if proxy, ok := filteredProxies[name]; ok {
+				groupProxies[name] = proxy
+			}
+		}
+		filteredProxies = groupProxies
+	}
 	return filteredProxies, nil
 }
 
+// ProxyGroups 返回上一次 LoadProxies 中解析出的策略组
+func (st *SpeedTester) ProxyGroups() []*ProxyGroup {
+	return st.groups
+}
+
+// providerSource 使用 proxy-provider 中的 url 和 header 作为拉取设置
+func providerSource(config map[string]any) Source {
+	source := Source{
+		Headers: make(map[string]string),
+	}
+	source.Path, _ = config["url"].(string)
+	if header, ok := config["header"].(map[string]any); ok {
+		for key, values := range header {
+			if list, ok := values.([]any); ok && len(list) > 0 {
+				source.Headers[key] = fmt.Sprint(list[0])
+			}
+		}
+	}
+	return source
+}
+
+// Duplicates 返回上一次 LoadProxies 中被去重的节点
+func (st *SpeedTester) Duplicates() []*DuplicateProxy {
+	return st.duplicates
+}
+
 func isStashCompatible(proxy *CProxy) bool {
 	switch proxy.Type() {
 	case constant.Shadowsocks:
@@ -291,9 +528,44 @@ func isStashCompatible(proxy *CProxy) bool {
 	return true
 }
 
+// TestProxies 测试所有节点，每个节点测试完成后调用 tester，需要测试过程中的事件时使用 Stream
 func (st *SpeedTester) TestProxies(proxies map[string]*CProxy, tester func(result *Result)) {
+	for event := range st.Stream(context.Background(), proxies) {
+		if finished, ok := event.(*ProxyFinishedEvent); ok {
+			tester(finished.Result)
+		}
+	}
+}
+
+func (st *SpeedTester) testProxies(ctx context.Context, proxies map[string]*CProxy, emit emitter, tester func(result *Result)) {
+	if st.config.Tiered && !st.config.FastMode {
+		st.testTiered(ctx, proxies, emit, tester)
+		return
+	}
+	st.testAll(ctx, proxies, emit, tester)
+}
+
+// testAll 依次完整测试每个节点，ctx 取消后不再测试剩余的节点
+func (st *SpeedTester) testAll(ctx context.Context, proxies map[string]*CProxy, emit emitter, tester func(result *Result)) {
+	st.startNodes(len(proxies))
 	for name, proxy := range proxies {
-		tester(st.testProxy(name, proxy))
+		if ctx.Err() != nil {
+			return
+		}
+		// 时间预算用完后剩余的节点不再测试
+		if st.timeExhausted() {
+			st.finishNode(BudgetUntested)
+			tester(&Result{
+				ProxyName:   name,
+				ProxyType:   proxy.Type().String(),
+				ProxyConfig: proxy.Config,
+				Budget:      BudgetUntested,
+			})
+			continue
+		}
+		result := st.testProxy(ctx, name, proxy, emit)
+		st.finishNode(result.Budget)
+		tester(result)
 	}
 }
 
@@ -315,6 +587,52 @@ type Result struct {
 	UploadSize    float64        `json:"upload_size"`
 	UploadTime    time.Duration  `json:"upload_time"`
 	UploadSpeed   float64        `json:"upload_speed"`
+	Hops          []*HopResult   `json:"hops,omitempty"`
+	// Protocol 延迟测试中实际协商的 HTTP 协议，例如 HTTP/2.0
+	Protocol string `json:"protocol,omitempty"`
+	// Latency 为空闲时的延迟，DownloadLatency 和 UploadLatency 为下载、上传期间的平均延迟，
+	// Bufferbloat 为负载下延迟增加量的评级（A+ 到 F）
+	DownloadLatency time.Duration `json:"download_latency"`
+	UploadLatency   time.Duration `json:"upload_latency"`
+	Bufferbloat     string        `json:"bufferbloat,omitempty"`
+	// LatencyStats 延迟的最小值、中位数、p90、p99、最大值和标准差，Jitter 为相邻两次延迟差值的平均值
+	LatencyStats *LatencyStats `json:"latency_stats,omitempty"`
+	// ColdLatency 每次使用新连接的平均延迟，包含节点握手和 TLS 握手，WarmLatency 为复用同一个连接的平均延迟
+	ColdLatency time.Duration `json:"cold_latency"`
+	WarmLatency time.Duration `json:"warm_latency"`
+	// Throttled 测试目标返回 429 或 503 并在重试后仍然限流，此时速度为 0 不代表节点不可用
+	Throttled bool `json:"throttled,omitempty"`
+	// Attempts 需要重试的阶段中单次测试最多尝试的次数，例如 {"download": 2}
+	Attempts Attempts `json:"attempts,omitempty"`
+	// Budget 预算不足时的处理：shrunk、skipped 或 untested
+	Budget string `json:"budget,omitempty"`
+	// Tier 分级测试中节点完成的阶段：latency、probe 或 full，probe 时 DownloadSpeed 为小文件的下载速度
+	Tier string `json:"tier,omitempty"`
+	// PhaseErrors 阶段返回的错误，键为阶段名称，Extra 为自定义阶段写入的结果
+	PhaseErrors map[string]string `json:"phase_errors,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+	// HoldSurvived 长连接测试中连接保持的时间，HoldReset 表示连接被中途关闭或重置，HoldError 为断开的原因，
+	// HoldFailed 表示没有建立连接（拨号、TLS 握手或 Upgrade 失败），此时 HoldError 为失败的原因
+	HoldSurvived time.Duration `json:"hold_survived,omitempty"`
+	HoldReset    bool          `json:"hold_reset,omitempty"`
+	HoldFailed   bool          `json:"hold_failed,omitempty"`
+	HoldError    string        `json:"hold_error,omitempty"`
+	// WebSocketUpgrade 为 WebSocket 握手时间，WebSocketLatency 为消息往返时间，WebSocketSpeed 为持续发送消息的吞吐量
+	WebSocketUpgrade time.Duration `json:"websocket_upgrade,omitempty"`
+	WebSocketLatency time.Duration `json:"websocket_latency,omitempty"`
+	WebSocketSpeed   float64       `json:"websocket_speed,omitempty"`
+	WebSocketError   string        `json:"websocket_error,omitempty"`
+	// Targets 配置了多个测试目标时每个目标的结果，顺序与配置一致
+	Targets []*TargetResult `json:"targets,omitempty"`
+
+	// node 内置阶段之间共享的状态，只在 testProxy 执行阶段期间存在
+	node *nodeTest
+}
+
+// HopResult 代理链中经过前若干跳时的延迟，Name 为这一跳的节点名称
+type HopResult struct {
+	Name    string        `json:"name"`
+	Latency time.Duration `json:"latency"`
 }
 
 func (r *Result) FormatDownloadSpeed() string {
@@ -354,212 +672,435 @@ func formatSpeed(bytesPerSecond float64) string {
 	return fmt.Sprintf("%.2f%s", speed, units[unit])
 }
 
-func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
+// testProxy 按 Config.Phases 的顺序执行每个测试阶段，内置阶段之间共享的状态保存在 result.node 中
+func (st *SpeedTester) testProxy(ctx context.Context, name string, proxy *CProxy, emit emitter) *Result {
 	result := &Result{
 		ProxyName:   name,
 		ProxyType:   proxy.Type().String(),
 		ProxyConfig: proxy.Config,
 	}
 
-	// 1. 首先进行延迟测试
-	latencyResult := st.testLatency(proxy, st.config.MaxLatency)
+	node := st.newNodeTest(name, proxy, emit)
+	if len(st.config.Targets) > 0 {
+		for _, t := range node.targets {
+			result.Targets = append(result.Targets, t.result)
+		}
+	}
+	result.node = node
+	defer func() { result.node = nil }()
+	for _, phase := range st.phases() {
+		var err error
+		if isBuiltinPhase(phase) {
+			err = phase.Run(ctx, proxy, result)
+		} else {
+			// 内置阶段自己记录用量，自定义阶段只记录时间
+			tracker := node.startPhase(phase.Name())
+			err = phase.Run(ctx, proxy, result)
+			tracker.finish()
+		}
+		if errors.Is(err, ErrSkipPhases) {
+			break
+		}
+		if err != nil {
+			if result.PhaseErrors == nil {
+				result.PhaseErrors = make(map[string]string)
+			}
+			result.PhaseErrors[phase.Name()] = err.Error()
+		}
+	}
+	return result
+}
+
+// testNodeWebSocket WebSocket 测试，没有通过延迟测试时跳过
+func (st *SpeedTester) testNodeWebSocket(node *nodeTest, proxy constant.Proxy, result *Result) {
+	wsURL := st.webSocketURL()
+	if !st.config.WebSocket || wsURL == "" || st.config.FastMode || !node.available() {
+		return
+	}
+	tracker := node.startPhase(PhaseWebSocket)
+	wsResult, err := st.testWebSocket(tracker.countProxy(proxy), wsURL)
+	tracker.finish()
+	if wsResult != nil {
+		result.WebSocketUpgrade = wsResult.upgradeTime
+		result.WebSocketLatency = wsResult.latency
+		result.WebSocketSpeed = wsResult.throughput
+	}
+	if err != nil {
+		result.WebSocketError = err.Error()
+	}
+}
+
+// testNodeHold 长连接测试，没有通过延迟测试时跳过
+func (st *SpeedTester) testNodeHold(node *nodeTest, proxy constant.Proxy, result *Result) {
+	holdURL := st.holdURL()
+	if st.config.HoldDuration <= 0 || holdURL == "" || st.config.FastMode || !node.available() {
+		return
+	}
+	tracker := node.startPhase(PhaseHold)
+	hold, err := st.testHold(tracker.countProxy(proxy), holdURL)
+	tracker.finish()
+	if err != nil {
+		result.HoldFailed = true
+		result.HoldError = err.Error()
+		return
+	}
+	result.HoldSurvived = hold.survived
+	result.HoldReset = hold.reset
+	if hold.err != nil {
+		result.HoldError = hold.err.Error()
+	}
+}
+
+// testNodeHops 代理链逐跳测试延迟，便于定位较慢的一跳
+func (st *SpeedTester) testNodeHops(node *nodeTest, result *Result) {
+	for _, hop := range node.proxy.Chain {
+		tracker := node.startPhase(PhaseLatency)
+		hopResult := st.testLatency(tracker.countProxy(hop), st.latencyProbe(hop), st.config.MaxLatency)
+		tracker.finish()
+		result.Hops = append(result.Hops, &HopResult{Name: hop.Name(), Latency: hopResult.avgLatency})
+	}
+}
+
+// testTargetLatency 测试目标的延迟，节点不可用、延迟过高或快速模式时不再进行下载和上传测试
+func (st *SpeedTester) testTargetLatency(ctx context.Context, node *nodeTest, proxy constant.Proxy, t *targetTest) {
+	result := t.result
+
+	// 所有请求都失败时按 latency 阶段的重试策略重新测试
+	tracker := node.startPhase(PhaseLatency)
+	var latencyResult *latencyResult
+	attempts, _ := st.Retry(ctx, PhaseLatency, func() error {
+		latencyResult = st.testLatency(tracker.countProxy(proxy), t.probe, st.config.MaxLatency)
+		return latencyResult.err
+	})
+	result.Attempts.Record(PhaseLatency, attempts)
 	result.Latency = latencyResult.avgLatency
+	result.Protocol = latencyResult.protocol
+	result.LatencyStats = latencyResult.stats
+	result.Throttled = latencyResult.throttled
+	tracker.finish()
+	t.measured = true
 	if st.config.FastMode {
-		return result
+		t.stopped = true
+		return
 	} else {
 		result.Jitter = latencyResult.jitter
 		result.PacketLoss = latencyResult.packetLoss
 	}
 
-	if result.PacketLoss == 100 || result.Latency > st.config.MaxLatency {
-		return result
+	// 所有延迟请求都被限流时没有可用的延迟
+	if result.PacketLoss == 100 || result.Latency == 0 || result.Latency > st.config.MaxLatency {
+		t.stopped = true
+		return
 	}
 
-	// 2. 并发进行下载和上传测试
-
-	var wg sync.WaitGroup
-
-	var totalDownloadBytes, totalUploadBytes int64
-	var totalDownloadTime, totalUploadTime time.Duration
-	var downloadCount, uploadCount int
-
-	downloadChunkSize := st.config.DownloadSize / st.config.Concurrent
-	if downloadChunkSize > 0 {
-		downloadResults := make(chan *downloadResult, st.config.Concurrent)
+	// 分别测试新建连接和复用连接的延迟
+	tracker = node.startPhase(PhaseLatency)
+	coldResult := st.testColdLatency(tracker.countProxy(proxy), t.probe, st.config.MaxLatency)
+	warmResult := st.testWarmLatency(tracker.countProxy(proxy), t.probe, st.config.MaxLatency)
+	result.ColdLatency = coldResult.avgLatency
+	result.WarmLatency = warmResult.avgLatency
+	result.Throttled = result.Throttled || coldResult.throttled || warmResult.throttled
+	tracker.finish()
+}
 
-		for i := 0; i < st.config.Concurrent; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				downloadResults <- st.testDownload(proxy, downloadChunkSize, st.config.Timeout)
-			}()
-		}
-		wg.Wait()
+// testTargetDownload 并发测试目标的下载速度，没有通过延迟测试时跳过，预算不足时缩小大小或跳过，速度低于 MinDownloadSpeed 时不再进行上传测试
+func (st *SpeedTester) testTargetDownload(ctx context.Context, node *nodeTest, proxy constant.Proxy, t *targetTest) {
+	if !t.available() || st.config.FastMode {
+		return
+	}
+	t.plan(st)
+	result := t.result
+	downloadChunkSize := t.downloadSize / st.config.Concurrent
+	if downloadChunkSize <= 0 {
+		return
+	}
 
-		for i := 0; i < st.config.Concurrent; i++ {
-			if dr := <-downloadResults; dr != nil {
-				totalDownloadBytes += dr.bytes
-				totalDownloadTime += dr.duration
-				downloadCount++
-			}
-		}
-		close(downloadResults)
+	tracker := node.startPhase(PhaseDownload)
+	downloadResults := make(chan *downloadResult, st.config.Concurrent)
+	stopProbe := st.startLoadedProbe(tracker.countProxy(proxy), t.probe)
 
-		if downloadCount > 0 {
-			result.DownloadSize = float64(totalDownloadBytes)
-			result.DownloadTime = totalDownloadTime / time.Duration(downloadCount)
-			result.DownloadSpeed = float64(totalDownloadBytes) / result.DownloadTime.Seconds()
+	var wg sync.WaitGroup
+	for i := 0; i < st.config.Concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			downloadResults <- st.testDownload(ctx, proxy, t.target, downloadChunkSize, st.config.Timeout, tracker)
+		}()
+	}
+	wg.Wait()
+	result.DownloadLatency = stopProbe()
+	result.Bufferbloat = bufferbloatGrade(result.Latency, result.DownloadLatency, result.UploadLatency)
+
+	// 各连接同时开始，速度为总字节数除以最慢的连接的时间，即整个传输经过的时间
+	var totalBytes int64
+	var elapsed time.Duration
+	var count int
+	for i := 0; i < st.config.Concurrent; i++ {
+		dr := <-downloadResults
+		result.Attempts.Record(PhaseDownload, dr.attempts)
+		if errors.Is(dr.err, errThrottled) {
+			result.Throttled = true
+			continue
 		}
-
-		if result.DownloadSpeed < st.config.MinDownloadSpeed {
-			return result
+		if dr.err != nil {
+			continue
 		}
+		totalBytes += dr.bytes
+		elapsed = max(elapsed, dr.duration)
+		count++
 	}
+	close(downloadResults)
+	tracker.finish()
 
-	uploadChunkSize := st.config.UploadSize / st.config.Concurrent
-	if uploadChunkSize > 0 {
-		uploadResults := make(chan *downloadResult, st.config.Concurrent)
+	if count > 0 {
+		result.DownloadSize = float64(totalBytes)
+		result.DownloadTime = elapsed
+		result.DownloadSpeed = float64(totalBytes) / result.DownloadTime.Seconds()
+	}
+	if result.DownloadSpeed < st.config.MinDownloadSpeed {
+		t.stopped = true
+	}
+}
 
-		for i := 0; i < st.config.Concurrent; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				uploadResults <- st.testUpload(proxy, uploadChunkSize, st.config.Timeout)
-			}()
-		}
-		wg.Wait()
+// testTargetUpload 并发测试目标的上传速度，没有通过延迟测试或下载速度过低时跳过
+func (st *SpeedTester) testTargetUpload(ctx context.Context, node *nodeTest, proxy constant.Proxy, t *targetTest) {
+	if !t.available() || st.config.FastMode {
+		return
+	}
+	t.plan(st)
+	result := t.result
+	uploadChunkSize := t.uploadSize / st.config.Concurrent
+	if uploadChunkSize <= 0 {
+		return
+	}
 
-		for i := 0; i < st.config.Concurrent; i++ {
-			if ur := <-uploadResults; ur != nil {
-				totalUploadBytes += ur.bytes
-				totalUploadTime += ur.duration
-				uploadCount++
-			}
-		}
-		close(uploadResults)
+	tracker := node.startPhase(PhaseUpload)
+	uploadResults := make(chan *downloadResult, st.config.Concurrent)
+	stopProbe := st.startLoadedProbe(tracker.countProxy(proxy), t.probe)
 
-		if uploadCount > 0 {
-			result.UploadSize = float64(totalUploadBytes)
-			result.UploadTime = totalUploadTime / time.Duration(uploadCount)
-			result.UploadSpeed = float64(totalUploadBytes) / result.UploadTime.Seconds()
+	var wg sync.WaitGroup
+	for i := 0; i < st.config.Concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uploadResults <- st.testUpload(ctx, proxy, t.target, uploadChunkSize, st.config.Timeout, tracker)
+		}()
+	}
+	wg.Wait()
+	result.UploadLatency = stopProbe()
+	result.Bufferbloat = bufferbloatGrade(result.Latency, result.DownloadLatency, result.UploadLatency)
+
+	// 各连接同时开始，速度为总字节数除以最慢的连接的时间，即整个传输经过的时间
+	var totalBytes int64
+	var elapsed time.Duration
+	var count int
+	for i := 0; i < st.config.Concurrent; i++ {
+		ur := <-uploadResults
+		result.Attempts.Record(PhaseUpload, ur.attempts)
+		if errors.Is(ur.err, errThrottled) {
+			result.Throttled = true
+			continue
 		}
-
-		if result.UploadSpeed < st.config.MinUploadSpeed {
-			return result
+		if ur.err != nil {
+			continue
 		}
+		totalBytes += ur.bytes
+		elapsed = max(elapsed, ur.duration)
+		count++
 	}
+	close(uploadResults)
+	tracker.finish()
 
-	return result
+	if count > 0 {
+		result.UploadSize = float64(totalBytes)
+		result.UploadTime = elapsed
+		result.UploadSpeed = float64(totalBytes) / result.UploadTime.Seconds()
+	}
+	if result.UploadSpeed < st.config.MinUploadSpeed {
+		t.stopped = true
+	}
 }
 
 type latencyResult struct {
 	avgLatency time.Duration
 	jitter     time.Duration
 	packetLoss float64
+	protocol   string
+	stats      *LatencyStats
+	// throttled 有请求被测试目标限流
+	throttled bool
+	// err 所有请求都失败时为最后一次失败的原因
+	err error
 }
 
-func (st *SpeedTester) testLatency(proxy constant.Proxy, minLatency time.Duration) *latencyResult {
-	client := st.createClient(proxy, minLatency)
-	latencies := make([]time.Duration, 0, 6)
-	failedPings := 0
+// LatencyStats 延迟测试的分布
+type LatencyStats struct {
+	Min    time.Duration `json:"min"`
+	Median time.Duration `json:"median"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+	Max    time.Duration `json:"max"`
+	StdDev time.Duration `json:"stddev"`
+}
 
-	for i := 0; i < 6; i++ {
-		time.Sleep(100 * time.Millisecond)
+// latencyProbe 延迟测试请求，节点没有指定 LatencyURL 时使用第一个测试目标
+func (st *SpeedTester) latencyProbe(proxy *CProxy) latencyProbe {
+	if proxy.LatencyURL != "" {
+		return latencyProbe{url: proxy.LatencyURL, method: http.MethodGet}
+	}
+	return st.targets()[0].latencyProbe()
+}
 
-		start := time.Now()
-		resp, err := client.Get(fmt.Sprintf("%s/__down?bytes=0", st.config.ServerURL))
-		if err != nil {
-			failedPings++
+// testLatency 按 LatencyCount 和 LatencyInterval 发送延迟测试请求，每个请求的超时为 LatencyTimeout，未设置时为 timeout
+func (st *SpeedTester) testLatency(proxy constant.Proxy, probe latencyProbe, timeout time.Duration) *latencyResult {
+	if st.config.LatencyTimeout > 0 {
+		timeout = st.config.LatencyTimeout
+	}
+	client := st.createClient(proxy, timeout)
+	defer client.CloseIdleConnections()
+	latencies := make([]time.Duration, 0, st.config.LatencyCount)
+	failedPings, throttledPings := 0, 0
+	protocol := ""
+	var lastErr error
+
+	// 第一个请求包含建立连接的时间，设置了 LatencySkipFirst 时额外发送一个请求并忽略它的结果
+	count := st.config.LatencyCount
+	if st.config.LatencySkipFirst {
+		count++
+	}
+	for i := 0; i < count; i++ {
+		time.Sleep(st.config.LatencyInterval)
+
+		latency, proto, err := st.probeLatency(client, probe)
+		if st.config.LatencySkipFirst && i == 0 {
 			continue
 		}
-		resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
-			latencies = append(latencies, time.Since(start))
-		} else {
+		// 被限流的请求不计入丢包
+		switch {
+		case err == nil:
+			latencies = append(latencies, latency)
+			protocol = proto
+		case errors.Is(err, errThrottled):
+			throttledPings++
+		default:
 			failedPings++
+			lastErr = err
 		}
 	}
 
-	return calculateLatencyStats(latencies, failedPings)
+	result := calculateLatencyStats(latencies, failedPings)
+	result.protocol = protocol
+	result.throttled = throttledPings > 0
+	if len(latencies) == 0 {
+		result.err = lastErr
+	}
+	return result
 }
 
 type downloadResult struct {
 	bytes    int64
 	duration time.Duration
+	// attempts 按重试策略实际尝试的次数，err 为最后一次失败的原因，被限流时为 errThrottled
+	attempts int
+	err      error
 }
 
-func (st *SpeedTester) testDownload(proxy constant.Proxy, size int, timeout time.Duration) *downloadResult {
-	client := st.createClient(proxy, timeout)
-	start := time.Now()
+// testDownload 按 download 阶段的重试策略测试下载，失败时 err 不为空，tracker 不为空时记录传输的字节数
+func (st *SpeedTester) testDownload(ctx context.Context, proxy constant.Proxy, target Target, size int, timeout time.Duration, tracker *phaseTracker) *downloadResult {
+	result := &downloadResult{}
+	result.attempts, result.err = st.Retry(ctx, PhaseDownload, func() error {
+		var err error
+		result.bytes, result.duration, err = st.downloadOnce(ctx, proxy, target, size, timeout, tracker)
+		return err
+	})
+	return result
+}
 
-	resp, err := client.Get(fmt.Sprintf("%s/__down?bytes=%d", st.config.ServerURL, size))
+// downloadOnce 最多读取 size 字节，文件更大时提前结束，ctx 取消时停止下载
+func (st *SpeedTester) downloadOnce(ctx context.Context, proxy constant.Proxy, target Target, size int, timeout time.Duration, tracker *phaseTracker) (int64, time.Duration, error) {
+	client := st.createClient(proxy, timeout)
+	defer client.CloseIdleConnections()
+	resp, start, err := st.do(client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.downloadURL(size), nil)
+		if err != nil {
+			return nil, err
+		}
+		if target.Range {
+			req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+		}
+		return req, nil
+	})
 	if err != nil {
-		return nil
+		return 0, 0, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil
+	// 服务器不支持 Range 时会返回 200 和完整文件
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, &statusError{code: resp.StatusCode, status: resp.Status}
 	}
 
-	downloadBytes, _ := io.Copy(io.Discard, resp.Body)
-
-	return &downloadResult{
-		bytes:    downloadBytes,
-		duration: time.Since(start),
+	// 文件小于 size 时以 io.EOF 结束；超时前已经下载的字节按慢速节点计算速度，
+	// 传输中连接被重置等错误按下载失败处理，可以按 reset 重试
+	downloadBytes, err := io.CopyN(io.Discard, tracker.countReader(st.limitReader(ctx, resp.Body)), int64(size))
+	duration := time.Since(start)
+	var netErr net.Error
+	if err != nil && err != io.EOF && !(downloadBytes > 0 && errors.As(err, &netErr) && netErr.Timeout()) {
+		return downloadBytes, duration, err
 	}
+	return downloadBytes, duration, nil
 }
 
-func (st *SpeedTester) testUpload(proxy constant.Proxy, size int, timeout time.Duration) *downloadResult {
+// testUpload 按 upload 阶段的重试策略测试上传，失败时 err 不为空，tracker 不为空时记录传输的字节数
+func (st *SpeedTester) testUpload(ctx context.Context, proxy constant.Proxy, target Target, size int, timeout time.Duration, tracker *phaseTracker) *downloadResult {
+	result := &downloadResult{}
+	result.attempts, result.err = st.Retry(ctx, PhaseUpload, func() error {
+		var err error
+		result.bytes, result.duration, err = st.uploadOnce(ctx, proxy, target, size, timeout, tracker)
+		return err
+	})
+	return result
+}
+
+// uploadOnce 上传 size 字节，ctx 取消时停止上传
+func (st *SpeedTester) uploadOnce(ctx context.Context, proxy constant.Proxy, target Target, size int, timeout time.Duration, tracker *phaseTracker) (int64, time.Duration, error) {
 	client := st.createClient(proxy, timeout)
-	reader := NewZeroReader(size)
-
-	start := time.Now()
-	resp, err := client.Post(
-		fmt.Sprintf("%s/__up", st.config.ServerURL),
-		"application/octet-stream",
-		reader,
-	)
+	defer client.CloseIdleConnections()
+	var reader *ZeroReader
+
+	// 重试时需要新的 reader
+	resp, start, err := st.do(client, func() (*http.Request, error) {
+		reader = NewZeroReader(size)
+		req, err := http.NewRequestWithContext(ctx, target.uploadMethod(), target.uploadURL(), tracker.countReader(st.limitReader(ctx, reader)))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(size)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
 	if err != nil {
-		return nil
+		return 0, 0, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil
-	}
-
-	return &downloadResult{
-		bytes:    reader.WrittenBytes(),
-		duration: time.Since(start),
+	// 对象存储的 PUT 可能返回 201 或 204
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return 0, 0, &statusError{code: resp.StatusCode, status: resp.Status}
 	}
+	return reader.WrittenBytes(), time.Since(start), nil
 }
 
 func (st *SpeedTester) createClient(proxy constant.Proxy, timeout time.Duration) *http.Client {
-	return &http.Client{
-		Timeout: timeout,
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				var u16Port uint16
-				if port, err := strconv.ParseUint(port, 10, 16); err == nil {
-					u16Port = uint16(port)
-				}
-				return proxy.DialContext(ctx, &constant.Metadata{
-					Host:    host,
-					DstPort: u16Port,
-				})
-			},
-		},
-	}
+	return newClient(proxy, timeout, st.config.Transport)
 }
 
+// calculateLatencyStats latencies 需要按发送顺序排列，jitter 为相邻两次延迟差值的平均值（RFC 3550），
+// 标准差记录在 stats.StdDev 中
 func calculateLatencyStats(latencies []time.Duration, failedPings int) *latencyResult {
-	result := &latencyResult{
-		packetLoss: float64(failedPings) / 6.0 * 100,
+	result := &latencyResult{}
+	if total := len(latencies) + failedPings; total > 0 {
+		result.packetLoss = float64(failedPings) / float64(total) * 100
 	}
 
 	if len(latencies) == 0 {
@@ -574,17 +1115,47 @@ func calculateLatencyStats(latencies []time.Duration, failedPings int) *latencyR
 	result.avgLatency = total / time.Duration(len(latencies))
 
 	// 计算抖动
+	var diffs time.Duration
+	for i := 1; i < len(latencies); i++ {
+		diff := latencies[i] - latencies[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		diffs += diff
+	}
+	if len(latencies) > 1 {
+		result.jitter = diffs / time.Duration(len(latencies)-1)
+	}
+
+	// 计算标准差
 	var variance float64
 	for _, l := range latencies {
 		diff := float64(l - result.avgLatency)
 		variance += diff * diff
 	}
 	variance /= float64(len(latencies))
-	result.jitter = time.Duration(math.Sqrt(variance))
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	result.stats = &LatencyStats{
+		Min:    sorted[0],
+		Median: percentile(sorted, 0.5),
+		P90:    percentile(sorted, 0.9),
+		P99:    percentile(sorted, 0.99),
+		Max:    sorted[len(sorted)-1],
+		StdDev: time.Duration(math.Sqrt(variance)),
+	}
 
 	return result
 }
 
+// percentile 使用最近秩法计算百分位数，sorted 需要升序排列
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
 func convertMappedIPv6ToIPv4(server string) string {
 	ip := net.ParseIP(server)
 	if ip == nil {
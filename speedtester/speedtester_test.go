@@ -0,0 +1,809 @@
+package speedtester
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+	"gopkg.in/yaml.v3"
+)
+
+// newTestConfig 使用本地 download-server 的测试配置，大小和次数足够小以便快速完成
+func newTestConfig(serverURL string) *Config {
+	return &Config{
+		ServerURL:       serverURL,
+		DownloadSize:    2 * 1024 * 1024,
+		UploadSize:      1024 * 1024,
+		Timeout:         10 * time.Second,
+		Concurrent:      2,
+		MaxLatency:      2 * time.Second,
+		LatencyCount:    3,
+		LatencyInterval: 10 * time.Millisecond,
+	}
+}
+
+func TestLoadProxies(t *testing.T) {
+	socks5 := startSocks5(t, "socks5")
+	httpProxy := startHTTPProxy(t, "http")
+	ss := startShadowsocks(t, "ss", "aes-128-gcm", "password")
+
+	// 与 socks5 相同服务器的节点会被去重，direct 不是测试的节点类型
+	duplicate := map[string]any{"name": "socks5 copy", "type": "socks5", "server": socks5["server"], "port": socks5["port"]}
+	blocked := startSocks5(t, "blocked socks5")
+	direct := map[string]any{"name": "direct", "type": "direct"}
+	ss2022 := startShadowsocks(t, "ss2022", "2022-blake3-aes-128-gcm", "AAAAAAAAAAAAAAAAAAAAAA==")
+	ss2022["cipher"] = "2022-blake3-chacha20-poly1305"
+	ss2022["password"] = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	path := writeConfig(t, &RawConfig{Proxies: []map[string]any{socks5, httpProxy, ss, duplicate, blocked, direct, ss2022}})
+
+	tests := []struct {
+		name            string
+		filter          string
+		stashCompatible bool
+		want            []string
+	}{
+		{name: "all", want: []string{"http", "socks5", "ss", "ss2022"}},
+		{name: "filter", filter: "^s", want: []string{"socks5", "ss", "ss2022"}},
+		{name: "stash compatible", stashCompatible: true, want: []string{"http", "socks5", "ss"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := New(&Config{ConfigPaths: path, FilterRegex: tt.filter, BlockRegex: "blocked"})
+			proxies, err := st.LoadProxies(tt.stashCompatible)
+			if err != nil {
+				t.Fatalf("LoadProxies: %v", err)
+			}
+			var names []string
+			for name := range proxies {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("proxies = %v, want %v", names, tt.want)
+			}
+			if duplicates := st.Duplicates(); len(duplicates) != 1 || !slices.Equal(duplicates[0].Names, []string{"socks5", "socks5 copy"}) {
+				t.Errorf("duplicates = %+v, want socks5 and socks5 copy", duplicates)
+			}
+		})
+	}
+}
+
+func TestLoadProviders(t *testing.T) {
+	body, err := yaml.Marshal(&RawConfig{Proxies: []map[string]any{
+		startSocks5(t, "hk 01"),
+		startHTTPProxy(t, "hk 02"),
+		startSocks5(t, "jp 01"),
+		startSocks5(t, "hk expired"),
+	}})
+	if err != nil {
+		t.Fatalf("marshal provider: %v", err)
+	}
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("subscription-userinfo", "upload=1; download=2; total=10")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	path := writeConfig(t, &RawConfig{Providers: map[string]map[string]any{
+		"remote": {
+			"type":           "http",
+			"url":            server.URL,
+			"filter":         "^hk",
+			"exclude-filter": "expired",
+			"exclude-type":   "http",
+			"override":       map[string]any{"additional-prefix": "remote ", "udp": true},
+		},
+	}})
+	cacheDir := t.TempDir()
+	// 第二次使用未过期的缓存，不再下载，但仍然报告订阅信息
+	for i := 0; i < 2; i++ {
+		st := New(&Config{ConfigPaths: path, ProviderCacheDir: cacheDir, ProviderCacheTTL: time.Hour})
+		proxies, err := st.LoadProxies(false)
+		if err != nil {
+			t.Fatalf("LoadProxies: %v", err)
+		}
+		proxy := proxies["[remote] remote hk 01"]
+		if len(proxies) != 1 || proxy == nil {
+			t.Fatalf("proxies = %v, want only [remote] remote hk 01", proxies)
+		}
+		if proxy.Config["name"] != "remote hk 01" || proxy.Config["udp"] != true {
+			t.Errorf("config = %v, want overridden name and udp", proxy.Config)
+		}
+		if subscriptions := st.Subscriptions(); len(subscriptions) != 1 || subscriptions[0].Total != 10 {
+			t.Errorf("subscriptions = %+v, want total 10", subscriptions)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+}
+
+func TestTestProxyThroughListeners(t *testing.T) {
+	serverURL := startDownloadServer(t)
+	path := writeConfig(t, &RawConfig{Proxies: []map[string]any{
+		startSocks5(t, "socks5"),
+		startHTTPProxy(t, "http"),
+		startShadowsocks(t, "ss", "chacha20-ietf-poly1305", "password"),
+	}})
+
+	config := newTestConfig(serverURL)
+	config.ConfigPaths = path
+	st := New(config)
+	proxies, err := st.LoadProxies(false)
+	if err != nil {
+		t.Fatalf("LoadProxies: %v", err)
+	}
+	if len(proxies) != 3 {
+		t.Fatalf("loaded %d proxies, want 3", len(proxies))
+	}
+	for name, proxy := range proxies {
+		t.Run(name, func(t *testing.T) {
+			result := st.testProxy(context.Background(), name, proxy, nil)
+			if result.Latency <= 0 || result.PacketLoss != 0 {
+				t.Errorf("latency = %s, packet loss = %.1f%%, want a reachable proxy", result.Latency, result.PacketLoss)
+			}
+			if result.DownloadSize != float64(config.DownloadSize) || result.DownloadSpeed <= 0 {
+				t.Errorf("download %.0f bytes at %s, want %d bytes", result.DownloadSize, result.FormatDownloadSpeed(), config.DownloadSize)
+			}
+			if result.UploadSize != float64(config.UploadSize) || result.UploadSpeed <= 0 {
+				t.Errorf("upload %.0f bytes at %s, want %d bytes", result.UploadSize, result.FormatUploadSpeed(), config.UploadSize)
+			}
+			if result.ColdLatency <= 0 || result.WarmLatency <= 0 {
+				t.Errorf("cold latency = %s, warm latency = %s, want both measured", result.ColdLatency, result.WarmLatency)
+			}
+		})
+	}
+}
+
+func TestLoadProxiesChains(t *testing.T) {
+	serverURL := startDownloadServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener.Close()
+
+	chained := startHTTPProxy(t, "chained")
+	chained["dialer-proxy"] = "hop"
+	broken := startHTTPProxy(t, "broken")
+	broken["dialer-proxy"] = "dead"
+	// relay 的中间一跳有自己的 dialer-proxy，连接需要经过 via
+	var viaConns atomic.Int32
+	middle := startSocks5(t, "middle")
+	middle["dialer-proxy"] = "via"
+	path := writeConfig(t, &RawConfig{
+		Proxies: []map[string]any{
+			startSocks5(t, "hop"),
+			chained,
+			proxyConfig(t, "dead", "socks5", listener.Addr().String(), nil),
+			broken,
+			startCountingSocks5(t, "via", &viaConns),
+			middle,
+			startHTTPProxy(t, "last"),
+		},
+		ProxyGroups: []map[string]any{
+			{"name": "relay", "type": "relay", "proxies": []any{"hop", "chained"}},
+			{"name": "partial", "type": "relay", "proxies": []any{"hop", "chained", "missing"}},
+			{"name": "nested", "type": "relay", "proxies": []any{"hop", "middle", "last"}},
+		},
+	})
+
+	config := newTestConfig(serverURL)
+	config.ConfigPaths = path
+	config.DownloadSize = 0
+	config.UploadSize = 0
+	st := New(config)
+	proxies, err := st.LoadProxies(false)
+	if err != nil {
+		t.Fatalf("LoadProxies: %v", err)
+	}
+	// 成员不完整的 relay 策略组不参与测试
+	if proxies["relay"] == nil || proxies["partial"] != nil {
+		t.Fatalf("proxies = %v, want relay without partial", proxies)
+	}
+	if chain := proxies["chained"].Chain; len(chain) != 1 || chain[0] != proxies["hop"] {
+		t.Errorf("chained chain = %v, want hop", chain)
+	}
+
+	// 前置节点不可用时经过它的节点也不可用，说明连接确实经过了代理链
+	for name, reachable := range map[string]bool{"chained": true, "relay": true, "broken": false} {
+		result := st.testProxy(context.Background(), name, proxies[name], nil)
+		if (result.Latency > 0) != reachable {
+			t.Errorf("%s latency = %s, reachable = %v", name, result.Latency, reachable)
+		}
+	}
+
+	viaConns.Store(0)
+	if result := st.testProxy(context.Background(), "nested", proxies["nested"], nil); result.Latency <= 0 {
+		t.Errorf("nested latency = %s, want reachable", result.Latency)
+	}
+	if viaConns.Load() == 0 {
+		t.Error("nested relay did not dial middle through its dialer-proxy via")
+	}
+}
+
+func TestTestProxyLatency(t *testing.T) {
+	config := newTestConfig(startDownloadServer(t))
+	config.DownloadSize = 0
+	config.UploadSize = 0
+	st := New(config)
+
+	proxy := newFakeProxy(t, "slow")
+	proxy.latency = 50 * time.Millisecond
+	result := st.testProxy(context.Background(), "slow", proxy.cproxy(), nil)
+	if result.Latency < proxy.latency || result.Latency > proxy.latency+200*time.Millisecond {
+		t.Errorf("latency = %s, want about %s", result.Latency, proxy.latency)
+	}
+	if result.LatencyStats == nil || result.LatencyStats.Min < proxy.latency {
+		t.Errorf("latency stats = %+v, want min at least %s", result.LatencyStats, proxy.latency)
+	}
+}
+
+func TestWarmLatencyReusesConnection(t *testing.T) {
+	// 延迟测试地址可能返回较大的响应体，读完之后才能复用连接
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4*1024*1024))
+	}))
+	t.Cleanup(server.Close)
+
+	st := New(newTestConfig(""))
+	proxy := newFakeProxy(t, "node")
+	result := st.testWarmLatency(proxy, latencyProbe{url: server.URL, method: http.MethodGet}, time.Second)
+	if result.avgLatency <= 0 || result.packetLoss != 0 {
+		t.Fatalf("latency = %s, packet loss = %.1f%%, want all requests succeed", result.avgLatency, result.packetLoss)
+	}
+	if dials := proxy.dials.Load(); dials != 1 {
+		t.Errorf("dials = %d, want 1", dials)
+	}
+}
+
+func TestTestProxyGetTargetLatency(t *testing.T) {
+	var gets, heads atomic.Int32
+	file := bytes.NewReader(make([]byte, 4*1024*1024))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		} else {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, file)
+	}))
+	t.Cleanup(server.Close)
+
+	config := newTestConfig("")
+	config.Targets = []Target{{Name: "file", URL: server.URL + "/file.bin", Protocol: ProtocolGet}}
+	config.DownloadSize = 0
+	config.UploadSize = 0
+	st := New(config)
+
+	// 延迟测试、新建连接和复用连接的延迟测试都不下载文件
+	proxy := newFakeProxy(t, "node")
+	result := st.testProxy(context.Background(), "node", proxy.cproxy(), nil)
+	if result.Latency <= 0 || result.ColdLatency <= 0 || result.WarmLatency <= 0 {
+		t.Errorf("latency = %s, cold = %s, warm = %s, want all measured", result.Latency, result.ColdLatency, result.WarmLatency)
+	}
+	if gets.Load() != 0 || heads.Load() == 0 {
+		t.Errorf("GET requests = %d, HEAD requests = %d, want only HEAD", gets.Load(), heads.Load())
+	}
+}
+
+// TestTestProxyBandwidth 并发下载时速度为总字节数除以整个下载经过的时间，
+// 带宽不同时由最慢的连接决定，超时的连接按超时前下载的字节计算
+func TestTestProxyBandwidth(t *testing.T) {
+	serverURL := startDownloadServer(t)
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatalf("parse server url: %v", err)
+	}
+	// 延迟测试使用单独的服务器，只有下载连接经过 download-server
+	latencyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(latencyServer.Close)
+
+	const mb = 1024 * 1024
+	tests := []struct {
+		name string
+		// bandwidths 为依次建立的下载连接的带宽，timeout 为下载超时时间
+		bandwidths []int
+		timeout    time.Duration
+		// want 为期望的下载速度，每个连接下载 1MB
+		want float64
+	}{
+		{name: "equal", bandwidths: []int{4 * mb, 4 * mb, 4 * mb, 4 * mb}, want: 16 * mb},
+		// 最慢的连接需要 1 秒，4MB 在 1 秒内下载完成
+		{name: "unequal", bandwidths: []int{1 * mb, 4 * mb, 4 * mb, 4 * mb}, want: 4 * mb},
+		// 每个连接只能在超时前下载 256KB
+		{name: "slow", bandwidths: []int{512 * 1024, 512 * 1024, 512 * 1024, 512 * 1024}, timeout: 500 * time.Millisecond, want: 2 * mb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig(serverURL)
+			config.Concurrent = len(tt.bandwidths)
+			config.DownloadSize = len(tt.bandwidths) * mb
+			config.UploadSize = 0
+			if tt.timeout > 0 {
+				config.Timeout = tt.timeout
+			}
+			st := New(config)
+
+			proxy := newFakeProxy(t, tt.name)
+			var downloads atomic.Int32
+			proxy.connBandwidth = func(metadata *constant.Metadata) int {
+				if strconv.Itoa(int(metadata.DstPort)) != server.Port() {
+					return 0
+				}
+				return tt.bandwidths[int(downloads.Add(1)-1)%len(tt.bandwidths)]
+			}
+			cproxy := proxy.cproxy()
+			cproxy.LatencyURL = latencyServer.URL
+			result := st.testProxy(context.Background(), tt.name, cproxy, nil)
+
+			if result.DownloadSpeed < tt.want*0.6 || result.DownloadSpeed > tt.want*1.2 {
+				t.Errorf("download speed = %s, want about %s", result.FormatDownloadSpeed(), formatSpeed(tt.want))
+			}
+			if tt.timeout > 0 && result.DownloadSize >= float64(config.DownloadSize) {
+				t.Errorf("downloaded %.0f bytes, want part of %d bytes before timeout", result.DownloadSize, config.DownloadSize)
+			}
+		})
+	}
+}
+
+func TestDownloadOnce(t *testing.T) {
+	st := New(newTestConfig(startDownloadServer(t)))
+	target := st.targets()[0]
+	size := 1024 * 1024
+
+	tests := []struct {
+		name       string
+		bandwidth  int
+		resetAfter int64
+		wantErr    string
+	}{
+		// 超时前下载的字节用于计算慢速节点的速度
+		{name: "slow", bandwidth: 256 * 1024},
+		{name: "reset", resetAfter: 64 * 1024, wantErr: RetryReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newFakeProxy(t, tt.name)
+			proxy.bandwidth = tt.bandwidth
+			proxy.resetAfter = tt.resetAfter
+			bytes, duration, err := st.downloadOnce(context.Background(), proxy, target, size, 300*time.Millisecond, nil)
+			if class := errorClass(err); (err != nil || tt.wantErr != "") && class != tt.wantErr {
+				t.Fatalf("err = %v (%q), want %q", err, class, tt.wantErr)
+			}
+			if err == nil && (bytes <= 0 || bytes >= int64(size) || duration <= 0) {
+				t.Errorf("downloaded %d bytes in %s, want part of %d bytes", bytes, duration, size)
+			}
+		})
+	}
+}
+
+func TestLimitReaderCancel(t *testing.T) {
+	config := newTestConfig("")
+	config.BandwidthLimit = 32 * 1024
+	st := New(config)
+
+	// 取消后不再等待带宽，读取立即结束
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := io.Copy(io.Discard, st.limitReader(ctx, NewZeroReader(1024*1024)))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read took %s after cancel, want it to stop promptly", elapsed)
+	}
+}
+
+func TestTestProxyUsage(t *testing.T) {
+	config := newTestConfig(startDownloadServer(t))
+	config.UploadSize = 0
+	config.WebSocket = true
+	st := New(config)
+
+	proxy := newFakeProxy(t, "node")
+	st.testProxy(context.Background(), "node", proxy.cproxy(), nil)
+
+	// 延迟测试没有响应体，按连接读写的字节数计入用量
+	usage := make(map[string]int64)
+	for _, phase := range st.BudgetReport().Phases {
+		usage[phase.Phase] = phase.Bytes
+	}
+	if usage[PhaseLatency] <= 0 || usage[PhaseWebSocket] <= 0 {
+		t.Errorf("latency bytes = %d, websocket bytes = %d, want both counted", usage[PhaseLatency], usage[PhaseWebSocket])
+	}
+	if usage[PhaseDownload] < int64(config.DownloadSize) {
+		t.Errorf("download bytes = %d, want at least %d", usage[PhaseDownload], config.DownloadSize)
+	}
+}
+
+func TestStreamConcurrent(t *testing.T) {
+	config := newTestConfig(startDownloadServer(t))
+	config.DownloadSize = 0
+	config.UploadSize = 0
+	st := New(config)
+
+	// 同时运行的 Stream 只收到自己的节点的阶段事件
+	streams := map[string]<-chan Event{
+		"a": st.Stream(context.Background(), map[string]*CProxy{"a": newFakeProxy(t, "a").cproxy()}),
+		"b": st.Stream(context.Background(), map[string]*CProxy{"b": newFakeProxy(t, "b").cproxy()}),
+	}
+	done := make(chan struct{})
+	for name, events := range streams {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			started := 0
+			for event := range events {
+				if event, ok := event.(*PhaseStartedEvent); ok {
+					started++
+					if event.ProxyName != name {
+						t.Errorf("stream %s received phase event of %s", name, event.ProxyName)
+					}
+				}
+			}
+			if started == 0 {
+				t.Errorf("stream %s received no phase events", name)
+			}
+		}()
+	}
+	for range streams {
+		<-done
+	}
+}
+
+func TestParsePhases(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: "latency,download,upload,websocket,hold,hops"},
+		{value: "hops,latency,hold"},
+		{value: "download,latency", wantErr: true},
+		{value: "latency,unknown", wantErr: true},
+		{value: "websocket", wantErr: true},
+	}
+	for _, tt := range tests {
+		phases, err := ParsePhases(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePhases(%q) err = %v, want error %v", tt.value, err, tt.wantErr)
+		}
+		if err == nil && len(phases) != len(strings.Split(tt.value, ",")) {
+			t.Errorf("ParsePhases(%q) = %d phases", tt.value, len(phases))
+		}
+	}
+}
+
+func TestTestProxyPhaseOrder(t *testing.T) {
+	config := newTestConfig(startDownloadServer(t))
+	config.UploadSize = 0
+	// 直接设置的 Phases 不经过 ParsePhases，下载测试排在延迟测试之前时跳过
+	config.Phases = []Phase{DownloadPhase, LatencyPhase}
+	st := New(config)
+
+	result := st.testProxy(context.Background(), "node", newFakeProxy(t, "node").cproxy(), nil)
+	if result.Latency <= 0 {
+		t.Errorf("latency = %s, want measured", result.Latency)
+	}
+	if result.DownloadSpeed != 0 {
+		t.Errorf("download speed = %s, want not tested before latency", result.FormatDownloadSpeed())
+	}
+}
+
+// countingPhase 包装内置阶段，记录阶段通过传入的 proxy 建立的连接数
+type countingPhase struct {
+	Phase
+	dials *atomic.Int64
+}
+
+func (p countingPhase) Run(ctx context.Context, proxy constant.Proxy, result *Result) error {
+	counter := &countingProxy{Proxy: proxy}
+	err := p.Phase.Run(ctx, counter, result)
+	p.dials.Add(counter.dials.Load())
+	return err
+}
+
+func TestTestProxyWrappedPhases(t *testing.T) {
+	config := newTestConfig(startDownloadServer(t))
+	config.UploadSize = 0
+	var latencyDials, downloadDials atomic.Int64
+	config.Phases = []Phase{countingPhase{LatencyPhase, &latencyDials}, countingPhase{DownloadPhase, &downloadDials}}
+	st := New(config)
+
+	// 包装后的内置阶段仍然共享节点的测试状态，并通过包装的 proxy 连接
+	result := st.testProxy(context.Background(), "node", newFakeProxy(t, "node").cproxy(), nil)
+	if result.Latency <= 0 || result.DownloadSpeed <= 0 {
+		t.Errorf("latency = %s, download speed = %s, want both measured", result.Latency, result.FormatDownloadSpeed())
+	}
+	if latencyDials.Load() == 0 || downloadDials.Load() == 0 {
+		t.Errorf("latency dials = %d, download dials = %d, want both through the wrapped proxy", latencyDials.Load(), downloadDials.Load())
+	}
+	if err := LatencyPhase.Run(context.Background(), newFakeProxy(t, "node"), &Result{}); !errors.Is(err, errBuiltinPhase) {
+		t.Errorf("run builtin phase outside SpeedTester: err = %v, want %v", err, errBuiltinPhase)
+	}
+}
+
+func TestTestProxyFailures(t *testing.T) {
+	serverURL := startDownloadServer(t)
+
+	t.Run("unreachable", func(t *testing.T) {
+		st := New(newTestConfig(serverURL))
+		proxy := newFakeProxy(t, "dead")
+		proxy.failDials = 1 << 30
+		result := st.testProxy(context.Background(), "dead", proxy.cproxy(), nil)
+		if result.PacketLoss != 100 || result.Latency != 0 {
+			t.Errorf("latency = %s, packet loss = %.1f%%, want an unreachable proxy", result.Latency, result.PacketLoss)
+		}
+		if result.DownloadSpeed != 0 || result.UploadSpeed != 0 {
+			t.Errorf("download = %s, upload = %s, want no throughput test", result.FormatDownloadSpeed(), result.FormatUploadSpeed())
+		}
+	})
+
+	t.Run("latency retry", func(t *testing.T) {
+		config := newTestConfig(serverURL)
+		config.Retry = map[string]RetryPolicy{PhaseLatency: {Attempts: 2}}
+		st := New(config)
+		proxy := newFakeProxy(t, "flaky")
+		// 第一次延迟测试的所有请求都失败
+		proxy.failDials = int32(config.LatencyCount)
+		result := st.testProxy(context.Background(), "flaky", proxy.cproxy(), nil)
+		if result.Attempts[PhaseLatency] != 2 {
+			t.Errorf("latency attempts = %d, want 2", result.Attempts[PhaseLatency])
+		}
+		if result.Latency <= 0 || result.DownloadSpeed <= 0 {
+			t.Errorf("latency = %s, download = %s, want the retry to succeed", result.Latency, result.FormatDownloadSpeed())
+		}
+	})
+
+	t.Run("download reset", func(t *testing.T) {
+		config := newTestConfig(serverURL)
+		config.UploadSize = 0
+		config.Retry = map[string]RetryPolicy{PhaseDownload: {Attempts: 2}}
+		st := New(config)
+		proxy := newFakeProxy(t, "reset")
+		proxy.resetAfter = 256 * 1024
+		result := st.testProxy(context.Background(), "reset", proxy.cproxy(), nil)
+		if result.Latency <= 0 {
+			t.Fatalf("latency = %s, want a reachable proxy", result.Latency)
+		}
+		if result.Attempts[PhaseDownload] != 2 || result.DownloadSpeed != 0 {
+			t.Errorf("download attempts = %d, speed = %s, want 2 failed attempts", result.Attempts[PhaseDownload], result.FormatDownloadSpeed())
+		}
+	})
+}
+
+func TestTargets(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   Target
+	}{
+		{
+			name:   "cloudflare",
+			config: Config{ServerURL: "https://speed.cloudflare.com"},
+			want:   Target{Name: "default", URL: "https://speed.cloudflare.com", Protocol: ProtocolCloudflare},
+		},
+		{
+			name:   "download server",
+			config: Config{ServerURL: "https://speed.example.com"},
+			want:   Target{Name: "default", URL: "https://speed.example.com", Protocol: ProtocolDownloadServer},
+		},
+		{
+			// 只设置 DownloadURL 时仍然使用 ServerURL 测试上传
+			name:   "download url",
+			config: Config{ServerURL: "https://speed.example.com", DownloadURL: "https://cdn.example.com/1GB.bin", UploadMethod: http.MethodPut},
+			want:   Target{Name: "default", URL: "https://cdn.example.com/1GB.bin", Protocol: ProtocolGet, UploadURL: "https://speed.example.com/__up", UploadMethod: http.MethodPost},
+		},
+		{
+			name:   "upload url",
+			config: Config{ServerURL: "https://speed.example.com", UploadURL: "https://s3.example.com/bucket/test", UploadMethod: http.MethodPut},
+			want:   Target{Name: "default", URL: "https://speed.example.com", Protocol: ProtocolDownloadServer, UploadURL: "https://s3.example.com/bucket/test", UploadMethod: http.MethodPut},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := New(&tt.config)
+			targets := st.targets()
+			if len(targets) != 1 || targets[0] != tt.want {
+				t.Fatalf("targets = %+v, want %+v", targets, tt.want)
+			}
+			if got := targets[0].uploadURL(); got == "" {
+				t.Errorf("upload url is empty, want upload test")
+			}
+		})
+	}
+}
+
+func TestTestProxyHold(t *testing.T) {
+	serverURL := startDownloadServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener.Close()
+
+	tests := []struct {
+		name    string
+		holdURL string
+		failed  bool
+	}{
+		{name: "survived"},
+		// 连接 echo 地址失败是错误，不是连接中断
+		{name: "dial failure", holdURL: "http://" + listener.Addr().String() + "/__echo", failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig(serverURL)
+			config.DownloadSize = 0
+			config.UploadSize = 0
+			config.HoldDuration = 100 * time.Millisecond
+			config.HoldIdle = 20 * time.Millisecond
+			config.HoldURL = tt.holdURL
+			st := New(config)
+
+			result := st.testProxy(context.Background(), "node", newFakeProxy(t, "node").cproxy(), nil)
+			if result.HoldFailed != tt.failed || result.HoldReset {
+				t.Fatalf("hold failed = %v, reset = %v, error = %q, want failed = %v", result.HoldFailed, result.HoldReset, result.HoldError, tt.failed)
+			}
+			if !tt.failed && (result.HoldSurvived < config.HoldDuration || result.HoldError != "") {
+				t.Errorf("hold survived %s with error %q, want %s", result.HoldSurvived, result.HoldError, config.HoldDuration)
+			}
+		})
+	}
+}
+
+func TestStabilityConcurrent(t *testing.T) {
+	config := newTestConfig(startDownloadServer(t))
+	config.StabilityInterval = 50 * time.Millisecond
+	config.StabilityConcurrent = 2
+	st := New(config)
+
+	proxies := make(map[string]*CProxy)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		proxies[name] = newFakeProxy(t, name).cproxy()
+	}
+	duration := 300 * time.Millisecond
+	// 4 个节点分两批测试，总时间为两倍的 duration
+	total := st.StabilityDuration(len(proxies), duration)
+	if total != 2*duration {
+		t.Errorf("stability duration = %s, want %s", total, 2*duration)
+	}
+	var starts []time.Time
+	begin := time.Now()
+	st.TestStability(proxies, duration, func(result *StabilityResult) {
+		if result.Probes == 0 || result.Uptime != 100 {
+			t.Errorf("%s probes = %d, uptime = %s, want all probes succeed", result.ProxyName, result.Probes, result.FormatUptime())
+		}
+		starts = append(starts, result.Start)
+	})
+	if len(starts) != len(proxies) {
+		t.Fatalf("got %d results, want %d", len(starts), len(proxies))
+	}
+	if elapsed := time.Since(begin); elapsed > total+config.StabilityInterval {
+		t.Errorf("stability test took %s, want at most %s", elapsed, total)
+	}
+	// 同时只测试 2 个节点，后两个节点在前两个节点测试完成之后才开始
+	slices.SortFunc(starts, func(a, b time.Time) int { return a.Compare(b) })
+	if gap := starts[2].Sub(starts[0]); gap < duration-config.StabilityInterval {
+		t.Errorf("third node started %s after the first, want at least %s", gap, duration-config.StabilityInterval)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 100: maxRetryBackoff} {
+		if got := retryBackoff(time.Second, attempt); got != want {
+			t.Errorf("retryBackoff(1s, %d) = %s, want %s", attempt, got, want)
+		}
+	}
+
+	// 等待重试时 ctx 结束，不再重试
+	st := New(&Config{Retry: map[string]RetryPolicy{PhaseDownload: {Attempts: 3, Backoff: time.Hour}}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	attempts, err := st.Retry(ctx, PhaseDownload, func() error { return syscall.ECONNRESET })
+	if attempts != 1 || !errors.Is(err, syscall.ECONNRESET) || time.Since(start) > time.Second {
+		t.Errorf("attempts = %d, err = %v after %s, want 1 attempt returned when ctx is done", attempts, err, time.Since(start))
+	}
+}
+
+func TestCalculateLatencyStats(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name        string
+		latencies   []time.Duration
+		failedPings int
+		avg         time.Duration
+		jitter      time.Duration
+		packetLoss  float64
+		stats       *LatencyStats
+	}{
+		{name: "empty"},
+		{name: "all failed", failedPings: 3, packetLoss: 100},
+		{
+			name:      "single",
+			latencies: []time.Duration{15 * ms},
+			avg:       15 * ms,
+			stats:     &LatencyStats{Min: 15 * ms, Median: 15 * ms, P90: 15 * ms, P99: 15 * ms, Max: 15 * ms},
+		},
+		{
+			name:        "with loss",
+			latencies:   []time.Duration{10 * ms, 30 * ms, 20 * ms, 40 * ms},
+			failedPings: 1,
+			avg:         25 * ms,
+			jitter:      50 * ms / 3,
+			packetLoss:  20,
+			stats:       &LatencyStats{Min: 10 * ms, Median: 20 * ms, P90: 40 * ms, P99: 40 * ms, Max: 40 * ms, StdDev: 11180339},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := calculateLatencyStats(tt.latencies, tt.failedPings)
+			if result.avgLatency != tt.avg || result.jitter != tt.jitter || result.packetLoss != tt.packetLoss {
+				t.Errorf("avg = %s, jitter = %s, packet loss = %.1f%%, want %s, %s, %.1f%%",
+					result.avgLatency, result.jitter, result.packetLoss, tt.avg, tt.jitter, tt.packetLoss)
+			}
+			switch {
+			case tt.stats == nil && result.stats != nil:
+				t.Errorf("stats = %+v, want nil", result.stats)
+			case tt.stats != nil && (result.stats == nil || *result.stats != *tt.stats):
+				t.Errorf("stats = %+v, want %+v", result.stats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestIsStashCompatible(t *testing.T) {
+	tests := []struct {
+		name      string
+		proxyType constant.AdapterType
+		config    map[string]any
+		want      bool
+	}{
+		{name: "socks5", proxyType: constant.Socks5, want: true},
+		{name: "ss supported cipher", proxyType: constant.Shadowsocks, config: map[string]any{"cipher": "aes-256-gcm"}, want: true},
+		{name: "ss unsupported cipher", proxyType: constant.Shadowsocks, config: map[string]any{"cipher": "2022-blake3-chacha20-poly1305"}},
+		{name: "ssr unsupported obfs", proxyType: constant.ShadowsocksR, config: map[string]any{"obfs": "tls1.2_ticket_auth", "protocol": "auth_chain_c"}},
+		{name: "vmess ws", proxyType: constant.Vmess, config: map[string]any{"cipher": "auto", "network": "ws"}, want: true},
+		{name: "vmess httpupgrade", proxyType: constant.Vmess, config: map[string]any{"network": "httpupgrade"}},
+		{name: "vless vision", proxyType: constant.Vless, config: map[string]any{"flow": "xtls-rprx-vision"}, want: true},
+		{name: "trojan h2", proxyType: constant.Trojan, config: map[string]any{"network": "h2"}},
+		{name: "snell obfs", proxyType: constant.Snell, config: map[string]any{"obfs-opts": map[string]any{"mode": "tls"}}, want: true},
+		{name: "mieru", proxyType: constant.Mieru},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &CProxy{Proxy: typedProxy{proxyType: tt.proxyType}, Config: tt.config}
+			if got := isStashCompatible(proxy); got != tt.want {
+				t.Errorf("isStashCompatible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// typedProxy 只用于判断节点类型
+type typedProxy struct {
+	constant.Proxy
+	proxyType constant.AdapterType
+}
+
+func (p typedProxy) Type() constant.AdapterType {
+	return p.proxyType
+}
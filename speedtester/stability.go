@@ -0,0 +1,211 @@
+package speedtester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// stabilityTransferSize 稳定性测试中每次下载测试的大小
+const stabilityTransferSize = 1024 * 1024
+
+// StabilityResult 稳定性测试结果
+type StabilityResult struct {
+	ProxyName   string         `json:"proxy_name"`
+	ProxyType   string         `json:"proxy_type"`
+	ProxyConfig map[string]any `json:"proxy_config"`
+	Start       time.Time      `json:"start"`
+	Duration    time.Duration  `json:"duration"`
+	Probes      int            `json:"probes"`
+	Failures    int            `json:"failures"`
+	// Uptime 成功的延迟测试占比（百分比），LongestOutage 为连续失败的最长时间
+	Uptime        float64       `json:"uptime"`
+	LongestOutage time.Duration `json:"longest_outage"`
+	// Reconnects 首次连接之后延迟测试重新建立连接的次数，服务器关闭空闲连接时也会重连
+	Reconnects    int           `json:"reconnects"`
+	Latency       time.Duration `json:"latency"`
+	Jitter        time.Duration `json:"jitter"`
+	LatencyStats  *LatencyStats `json:"latency_stats,omitempty"`
+	DownloadSpeed float64       `json:"download_speed"`
+	// Timeline 按时间顺序记录每次测试
+	Timeline []*StabilitySample `json:"timeline"`
+}
+
+// StabilitySample 稳定性测试中的一次测试，DownloadSpeed 只在下载测试时记录
+type StabilitySample struct {
+	Time          time.Time     `json:"time"`
+	Latency       time.Duration `json:"latency,omitempty"`
+	DownloadSpeed float64       `json:"download_speed,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+func (r *StabilityResult) FormatUptime() string {
+	return fmt.Sprintf("%.1f%%", r.Uptime)
+}
+
+// countingProxy 记录成功建立连接的次数
+type countingProxy struct {
+	constant.Proxy
+	dials atomic.Int64
+}
+
+func (p *countingProxy) DialContext(ctx context.Context, metadata *constant.Metadata) (constant.Conn, error) {
+	conn, err := p.Proxy.DialContext(ctx, metadata)
+	if err == nil {
+		p.dials.Add(1)
+	}
+	return conn, err
+}
+
+func (p *countingProxy) ListenPacketContext(ctx context.Context, metadata *constant.Metadata) (constant.PacketConn, error) {
+	pc, err := p.Proxy.ListenPacketContext(ctx, metadata)
+	if err == nil {
+		p.dials.Add(1)
+	}
+	return pc, err
+}
+
+// stabilityConcurrent 稳定性测试中同时测试的节点数
+func (st *SpeedTester) stabilityConcurrent(nodes int) int {
+	concurrent := st.config.StabilityConcurrent
+	if concurrent <= 0 || concurrent > nodes {
+		concurrent = nodes
+	}
+	return max(concurrent, 1)
+}
+
+// StabilityDuration 返回 TestStability 测试 nodes 个节点需要的时间，
+// 同时测试的节点数少于 nodes 时节点分批测试，每批需要 duration
+func (st *SpeedTester) StabilityDuration(nodes int, duration time.Duration) time.Duration {
+	concurrent := st.stabilityConcurrent(nodes)
+	batches := (nodes + concurrent - 1) / concurrent
+	return time.Duration(max(batches, 1)) * duration
+}
+
+// TestStability 在 duration 内按 StabilityInterval 测试每个节点的延迟，按 StabilityTransferInterval 进行小文件下载测试，
+// 最多同时测试 StabilityConcurrent 个节点，超出的节点等前面的节点测试完成后再开始，每个节点测试完成后调用 tester
+func (st *SpeedTester) TestStability(proxies map[string]*CProxy, duration time.Duration, tester func(result *StabilityResult)) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	concurrent := st.stabilityConcurrent(len(proxies))
+	// 错开第一批节点的测试时间，避免同时下载，之后的节点在前面的节点完成时开始，本身已经错开
+	offset := st.config.StabilityInterval / time.Duration(concurrent)
+	sem := make(chan struct{}, concurrent)
+	i := 0
+	for name, proxy := range proxies {
+		delay := time.Duration(0)
+		if i < concurrent {
+			delay = offset * time.Duration(i)
+		}
+		wg.Add(1)
+		go func(name string, proxy *CProxy, delay time.Duration) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			time.Sleep(delay)
+			result := st.testStability(name, proxy, duration-delay)
+			mu.Lock()
+			defer mu.Unlock()
+			tester(result)
+		}(name, proxy, delay)
+		i++
+	}
+	wg.Wait()
+}
+
+func (st *SpeedTester) testStability(name string, proxy *CProxy, duration time.Duration) *StabilityResult {
+	result := &StabilityResult{
+		ProxyName:   name,
+		ProxyType:   proxy.Type().String(),
+		ProxyConfig: proxy.Config,
+		Start:       time.Now(),
+	}
+	counter := &countingProxy{Proxy: proxy.Proxy}
+	target := st.targets()[0]
+	probe := st.latencyProbe(proxy)
+	timeout := st.config.MaxLatency
+	if st.config.LatencyTimeout > 0 {
+		timeout = st.config.LatencyTimeout
+	}
+	// 复用同一个连接，连接断开后重新建立的次数即为重连次数
+	client := st.createClient(counter, timeout)
+	defer client.CloseIdleConnections()
+
+	deadline := result.Start.Add(duration)
+	ticker := time.NewTicker(st.config.StabilityInterval)
+	defer ticker.Stop()
+
+	var latencies []time.Duration
+	var outageStart time.Time
+	var lastTransfer time.Time
+	var totalSpeed float64
+	var transfers int
+	for {
+		now := time.Now()
+		sample := &StabilitySample{Time: now}
+		latency, _, err := st.probeLatency(client, probe)
+		if err == nil {
+			sample.Latency = latency
+			latencies = append(latencies, latency)
+			if !outageStart.IsZero() {
+				result.LongestOutage = max(result.LongestOutage, now.Sub(outageStart))
+				outageStart = time.Time{}
+			}
+		} else if errors.Is(err, errThrottled) {
+			// 被限流不代表节点中断，不计入失败
+			sample.Error = errThrottled.Error()
+		} else {
+			sample.Error = "latency test failed"
+			result.Failures++
+			if outageStart.IsZero() {
+				outageStart = now
+			}
+		}
+		result.Probes++
+
+		if st.config.StabilityTransferInterval > 0 && sample.Error == "" && now.Sub(lastTransfer) >= st.config.StabilityTransferInterval {
+			lastTransfer = now
+			dr := st.testDownload(context.Background(), proxy, target, stabilityTransferSize, st.config.Timeout, nil)
+			if errors.Is(dr.err, errThrottled) {
+				sample.Error = errThrottled.Error()
+			} else if dr.err == nil && dr.duration > 0 {
+				sample.DownloadSpeed = float64(dr.bytes) / dr.duration.Seconds()
+				totalSpeed += sample.DownloadSpeed
+				transfers++
+			} else {
+				sample.Error = "download test failed"
+			}
+		}
+		result.Timeline = append(result.Timeline, sample)
+
+		if time.Now().Add(st.config.StabilityInterval).After(deadline) {
+			break
+		}
+		<-ticker.C
+	}
+
+	result.Duration = time.Since(result.Start)
+	if !outageStart.IsZero() {
+		result.LongestOutage = max(result.LongestOutage, time.Since(outageStart))
+	}
+	if result.Probes > 0 {
+		result.Uptime = float64(result.Probes-result.Failures) / float64(result.Probes) * 100
+	}
+	// 下载测试使用单独的连接，不计入重连次数
+	if dials := int(counter.dials.Load()); dials > 1 {
+		result.Reconnects = dials - 1
+	}
+	stats := calculateLatencyStats(latencies, result.Failures)
+	result.Latency = stats.avgLatency
+	result.Jitter = stats.jitter
+	result.LatencyStats = stats.stats
+	if transfers > 0 {
+		result.DownloadSpeed = totalSpeed / float64(transfers)
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package speedtester
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metacubex/mihomo/adapter/provider"
+	"github.com/metacubex/mihomo/log"
+)
+
+// Source 配置来源的拉取设置，Path 可以是本地文件或订阅地址
+type Source struct {
+	Path      string
+	UserAgent string
+	Headers   map[string]string
+}
+
+// SubscriptionInfo 订阅响应头中的流量和到期信息
+type SubscriptionInfo struct {
+	Source         string        `json:"source"`
+	Upload         int64         `json:"upload"`
+	Download       int64         `json:"download"`
+	Total          int64         `json:"total"`
+	Expire         time.Time     `json:"expire"`
+	UpdateInterval time.Duration `json:"update_interval"`
+}
+
+// Used 已使用的流量
+func (si *SubscriptionInfo) Used() int64 {
+	return si.Upload + si.Download
+}
+
+// Remaining 剩余流量，没有总量信息时返回 -1
+func (si *SubscriptionInfo) Remaining() int64 {
+	if si.Total <= 0 {
+		return -1
+	}
+	return si.Total - si.Used()
+}
+
+// sources 合并 ConfigPaths 和 Sources，Sources 中同名的来源提供额外的拉取设置
+func (st *SpeedTester) sources() []Source {
+	sources := make([]Source, 0)
+	index := make(map[string]int)
+	for _, path := range strings.Split(st.config.ConfigPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if _, ok := index[path]; ok {
+			continue
+		}
+		index[path] = len(sources)
+		sources = append(sources, Source{Path: path})
+	}
+	for _, source := range st.config.Sources {
+		if i, ok := index[source.Path]; ok {
+			sources[i] = source
+			continue
+		}
+		index[source.Path] = len(sources)
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// fetch 拉取订阅内容，设置了 fetch proxy 时通过代理下载，只有连接失败等网络错误时回退到直连
+func (st *SpeedTester) fetch(source Source) ([]byte, *SubscriptionInfo, error) {
+	if st.fetchProxy != nil {
+		body, info, err := st.fetchWithRetry(source, newClient(st.fetchProxy, st.config.FetchTimeout, TransportH1))
+		if err == nil {
+			return body, info, nil
+		}
+		// 收到了响应说明代理可用，4xx 和 5xx 不回退，避免把需要经过代理的请求直接发出去
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			return nil, nil, err
+		}
+		log.Warnln("failed to fetch %s through %s, fallback to direct: %s", sourceLabel(source.Path), st.fetchProxy.Name(), err)
+	}
+	return st.fetchWithRetry(source, http.DefaultClient)
+}
+
+// fetchWithRetry 网络错误和 5xx 响应会按 FetchRetries 重试
+func (st *SpeedTester) fetchWithRetry(source Source, client *http.Client) ([]byte, *SubscriptionInfo, error) {
+	var lastErr error
+	for attempt := 0; attempt <= st.config.FetchRetries; attempt++ {
+		if attempt > 0 {
+			log.Warnln("retry fetching %s (%d/%d): %s", sourceLabel(source.Path), attempt, st.config.FetchRetries, lastErr)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		body, info, retryable, err := st.fetchOnce(source, client)
+		if err == nil {
+			return body, info, nil
+		}
+		lastErr = err
+		if !retryable {
+			break
+		}
+	}
+	return nil, nil, lastErr
+}
+
+func (st *SpeedTester) fetchOnce(source Source, client *http.Client) ([]byte, *SubscriptionInfo, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), st.config.FetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.Path, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	userAgent := source.UserAgent
+	if userAgent == "" {
+		userAgent = st.config.FetchUserAgent
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	for key, value := range st.config.FetchHeaders {
+		req.Header.Set(key, value)
+	}
+	for key, value := range source.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, resp.StatusCode >= 500, &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	return body, parseSubscriptionInfo(sourceLabel(source.Path), resp.Header), false, nil
+}
+
+// parseSubscriptionInfo 解析 subscription-userinfo 和 profile-update-interval 响应头，两者都不存在时返回 nil
+func parseSubscriptionInfo(source string, header http.Header) *SubscriptionInfo {
+	userinfo := header.Get("subscription-userinfo")
+	interval := header.Get("profile-update-interval")
+	if userinfo == "" && interval == "" {
+		return nil
+	}
+
+	info := &SubscriptionInfo{Source: source}
+	if userinfo != "" {
+		si := provider.NewSubscriptionInfo(userinfo)
+		info.Upload = si.Upload
+		info.Download = si.Download
+		info.Total = si.Total
+		if si.Expire > 0 {
+			info.Expire = time.Unix(si.Expire, 0)
+		}
+	}
+	// profile-update-interval 的单位是小时
+	if hours, err := strconv.ParseFloat(strings.TrimSpace(interval), 64); err == nil && hours > 0 {
+		info.UpdateInterval = time.Duration(hours * float64(time.Hour))
+	}
+	return info
+}
+
+// Subscriptions 返回上一次 LoadProxies 中拉取到的订阅信息
+func (st *SpeedTester) Subscriptions() []*SubscriptionInfo {
+	return st.subscriptions
+}
@@ -0,0 +1,172 @@
+package speedtester
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 测试目标支持的协议
+const (
+	// ProtocolCloudflare 使用 Cloudflare 测速接口 /__down?bytes=N 和 /__up
+	ProtocolCloudflare = "cloudflare"
+	// ProtocolDownloadServer 使用自建的 download-server，接口与 Cloudflare 一致
+	ProtocolDownloadServer = "download-server"
+	// ProtocolGet 直接 GET 一个大文件，没有设置 UploadURL 时只测试延迟和下载速度
+	ProtocolGet = "get"
+)
+
+// cloudflareHost Cloudflare 测速接口的域名，也是 ServerURL 的默认值
+const cloudflareHost = "speed.cloudflare.com"
+
+// Target 测试目标，每个节点都会分别测试所有目标
+type Target struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Protocol string `json:"protocol"`
+	// Range 为 true 时 get 协议使用 Range 请求只下载需要的字节数
+	Range bool `json:"range,omitempty"`
+	// UploadURL 不为空时上传测试使用这个地址，UploadMethod 为 POST 或 PUT
+	UploadURL    string `json:"upload_url,omitempty"`
+	UploadMethod string `json:"upload_method,omitempty"`
+}
+
+// ParseTarget 解析 name=[protocol:]url 格式的测试目标，没有指定协议时使用 cloudflare
+func ParseTarget(s string) (Target, error) {
+	name, rest, ok := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	rest = strings.TrimSpace(rest)
+	if !ok || name == "" || rest == "" {
+		return Target{}, fmt.Errorf("invalid target %q, expected name=[protocol:]url", s)
+	}
+
+	target := Target{Name: name, URL: rest, Protocol: ProtocolCloudflare}
+	if protocol, url, ok := strings.Cut(rest, ":"); ok && strings.Contains(url, "://") {
+		target.Protocol = protocol
+		target.URL = url
+	}
+	switch target.Protocol {
+	case ProtocolCloudflare, ProtocolDownloadServer, ProtocolGet:
+	default:
+		return Target{}, fmt.Errorf("unsupported target protocol: %s", target.Protocol)
+	}
+	return target, nil
+}
+
+func (t Target) baseURL() string {
+	return strings.TrimSuffix(t.URL, "/")
+}
+
+// latencyProbe 延迟测试的请求地址和方法
+type latencyProbe struct {
+	url    string
+	method string
+}
+
+// latencyProbe get 协议使用 HEAD 请求，避免每次延迟测试都下载整个文件
+func (t Target) latencyProbe() latencyProbe {
+	if t.Protocol == ProtocolGet {
+		return latencyProbe{url: t.URL, method: http.MethodHead}
+	}
+	return latencyProbe{url: fmt.Sprintf("%s/__down?bytes=0", t.baseURL()), method: http.MethodGet}
+}
+
+func (t Target) downloadURL(size int) string {
+	if t.Protocol == ProtocolGet {
+		return t.URL
+	}
+	return fmt.Sprintf("%s/__down?bytes=%d", t.baseURL(), size)
+}
+
+// uploadURL 不支持上传测试时返回空字符串
+func (t Target) uploadURL() string {
+	if t.UploadURL != "" {
+		return t.UploadURL
+	}
+	if t.Protocol == ProtocolGet {
+		return ""
+	}
+	return fmt.Sprintf("%s/__up", t.baseURL())
+}
+
+func (t Target) uploadMethod() string {
+	if t.UploadURL != "" && t.UploadMethod != "" {
+		return t.UploadMethod
+	}
+	return http.MethodPost
+}
+
+// targets 返回测试目标，没有配置 Targets 时使用 ServerURL，
+// 设置了 DownloadURL 或 UploadURL 时分别代替 ServerURL 的下载和上传接口，只设置其中一个时另一个仍然使用 ServerURL
+func (st *SpeedTester) targets() []Target {
+	if len(st.config.Targets) > 0 {
+		targets := make([]Target, 0, len(st.config.Targets))
+		for _, target := range st.config.Targets {
+			if target.Protocol == ProtocolGet && st.config.DownloadRange {
+				target.Range = true
+			}
+			targets = append(targets, target)
+		}
+		return targets
+	}
+
+	// ServerURL 不是 Cloudflare 时是自建的 download-server，支持 /__echo 和 /__ws
+	target := Target{Name: "default", URL: st.config.ServerURL, Protocol: ProtocolDownloadServer}
+	if u, err := url.Parse(st.config.ServerURL); err == nil && u.Hostname() == cloudflareHost {
+		target.Protocol = ProtocolCloudflare
+	}
+	target.UploadURL = st.config.UploadURL
+	target.UploadMethod = st.config.UploadMethod
+	if st.config.DownloadURL != "" {
+		if target.UploadURL == "" {
+			target.UploadURL = target.uploadURL()
+			target.UploadMethod = http.MethodPost
+		}
+		target.URL = st.config.DownloadURL
+		target.Protocol = ProtocolGet
+		target.Range = st.config.DownloadRange
+	}
+	return []Target{target}
+}
+
+// TargetResult 单个测试目标的测试结果
+type TargetResult struct {
+	Name          string        `json:"name"`
+	Latency       time.Duration `json:"latency"`
+	Jitter        time.Duration `json:"jitter"`
+	PacketLoss    float64       `json:"packet_loss"`
+	DownloadSize  float64       `json:"download_size"`
+	DownloadTime  time.Duration `json:"download_time"`
+	DownloadSpeed float64       `json:"download_speed"`
+	UploadSize    float64       `json:"upload_size"`
+	UploadTime    time.Duration `json:"upload_time"`
+	UploadSpeed   float64       `json:"upload_speed"`
+	Protocol      string        `json:"protocol,omitempty"`
+	// 下载、上传期间的平均延迟和 bufferbloat 评级
+	DownloadLatency time.Duration `json:"download_latency"`
+	UploadLatency   time.Duration `json:"upload_latency"`
+	Bufferbloat     string        `json:"bufferbloat,omitempty"`
+	LatencyStats    *LatencyStats `json:"latency_stats,omitempty"`
+	ColdLatency     time.Duration `json:"cold_latency"`
+	WarmLatency     time.Duration `json:"warm_latency"`
+	Throttled       bool          `json:"throttled,omitempty"`
+	Attempts        Attempts      `json:"attempts,omitempty"`
+	Budget          string        `json:"budget,omitempty"`
+}
+
+func (r *TargetResult) FormatLatency() string {
+	if r.Latency == 0 {
+		return "N/A"
+	}
+	return fmt.Sprintf("%dms", r.Latency.Milliseconds())
+}
+
+func (r *TargetResult) FormatDownloadSpeed() string {
+	return formatSpeed(r.DownloadSpeed)
+}
+
+func (r *TargetResult) FormatUploadSpeed() string {
+	return formatSpeed(r.UploadSpeed)
+}
@@ -0,0 +1,119 @@
+package speedtester
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// 分级测试中节点完成的阶段
+const (
+	// TierLatency 只进行了延迟测试，节点不可用或延迟超过 MaxLatency
+	TierLatency = "latency"
+	// TierProbe 进行了小文件下载测试，下载速度为小文件的速度
+	TierProbe = "probe"
+	// TierFull 按 DownloadSize 和 UploadSize 进行了完整测试
+	TierFull = "full"
+)
+
+// tieredCandidate 通过延迟测试的节点和小文件下载速度
+type tieredCandidate struct {
+	name   string
+	proxy  *CProxy
+	result *Result
+	speed  float64
+}
+
+// testTiered 分级测试：先并发测试所有节点的延迟，再对可用节点进行 TieredProbeSize 的小文件下载测试，
+// 最后只对下载速度最快的 TieredTopK 个节点按 Config.Phases 进行完整测试，前两步固定进行延迟和下载测试
+func (st *SpeedTester) testTiered(ctx context.Context, proxies map[string]*CProxy, emit emitter, tester func(result *Result)) {
+	// 1. 并发测试延迟
+	var candidates []*tieredCandidate
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, st.config.TieredConcurrent)
+	for name, proxy := range proxies {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string, proxy *CProxy) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := st.sweepLatency(ctx, name, proxy, emit)
+			mu.Lock()
+			defer mu.Unlock()
+			if result.PacketLoss == 100 || result.Latency == 0 || result.Latency > st.config.MaxLatency {
+				tester(result)
+				return
+			}
+			candidates = append(candidates, &tieredCandidate{name: name, proxy: proxy, result: result})
+		}(name, proxy)
+	}
+	wg.Wait()
+
+	// 2. 依次进行小文件下载测试，避免互相影响
+	target := st.targets()[0]
+	for _, candidate := range candidates {
+		if ctx.Err() != nil {
+			return
+		}
+		tracker := st.startPhase(emit, candidate.name, PhaseDownload)
+		dr := st.testDownload(ctx, candidate.proxy, target, st.config.TieredProbeSize, st.config.Timeout, tracker)
+		tracker.finish()
+		candidate.result.Attempts.Record(PhaseDownload, dr.attempts)
+		if dr.err == nil && dr.duration > 0 {
+			candidate.speed = float64(dr.bytes) / dr.duration.Seconds()
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].speed != candidates[j].speed {
+			return candidates[i].speed > candidates[j].speed
+		}
+		return candidates[i].result.Latency < candidates[j].result.Latency
+	})
+
+	// 3. 对最快的 TieredTopK 个节点进行完整测试，其余节点使用小文件的下载速度
+	top := min(st.config.TieredTopK, len(candidates))
+	for _, candidate := range candidates[top:] {
+		candidate.result.Tier = TierProbe
+		candidate.result.DownloadSpeed = candidate.speed
+		tester(candidate.result)
+	}
+	full := make(map[string]*CProxy, top)
+	for _, candidate := range candidates[:top] {
+		full[candidate.name] = candidate.proxy
+	}
+	st.testAll(ctx, full, emit, func(result *Result) {
+		if result.Budget != BudgetUntested {
+			result.Tier = TierFull
+		}
+		tester(result)
+	})
+}
+
+// sweepLatency 分级测试第一阶段的延迟测试，结果与快速模式相同
+func (st *SpeedTester) sweepLatency(ctx context.Context, name string, proxy *CProxy, emit emitter) *Result {
+	result := &Result{
+		ProxyName:   name,
+		ProxyType:   proxy.Type().String(),
+		ProxyConfig: proxy.Config,
+		Tier:        TierLatency,
+	}
+	tracker := st.startPhase(emit, name, PhaseLatency)
+	var latencyResult *latencyResult
+	attempts, _ := st.Retry(ctx, PhaseLatency, func() error {
+		latencyResult = st.testLatency(tracker.countProxy(proxy), st.latencyProbe(proxy), st.config.MaxLatency)
+		return latencyResult.err
+	})
+	tracker.finish()
+	result.Attempts.Record(PhaseLatency, attempts)
+	result.Latency = latencyResult.avgLatency
+	result.Jitter = latencyResult.jitter
+	result.PacketLoss = latencyResult.packetLoss
+	result.Protocol = latencyResult.protocol
+	result.LatencyStats = latencyResult.stats
+	result.Throttled = latencyResult.throttled
+	return result
+}
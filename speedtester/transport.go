@@ -0,0 +1,115 @@
+package speedtester
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/quic-go"
+	"github.com/metacubex/quic-go/http3"
+	tls "github.com/metacubex/utls"
+)
+
+// 测试使用的 HTTP 协议
+const (
+	TransportH1 = "h1"
+	// TransportH2 通过 TLS ALPN 协商 HTTP/2，http:// 地址仍然使用 HTTP/1.1
+	TransportH2 = "h2"
+	// TransportH3 通过节点的 UDP 转发使用 QUIC，只支持 https:// 地址
+	TransportH3 = "h3"
+)
+
+// newClient 创建通过 proxy 发送请求的 http.Client
+func newClient(proxy constant.Proxy, timeout time.Duration, transport string) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	switch transport {
+	case TransportH3:
+		client.Transport = &http3.Transport{
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+				return dialQUIC(ctx, proxy, addr, tlsCfg, cfg)
+			},
+		}
+	case TransportH2:
+		client.Transport = &http.Transport{
+			DialContext:       proxyDialContext(proxy),
+			ForceAttemptHTTP2: true,
+		}
+	default:
+		client.Transport = &http.Transport{
+			DialContext: proxyDialContext(proxy),
+		}
+	}
+	return client
+}
+
+func proxyDialContext(proxy constant.Proxy) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var u16Port uint16
+		if port, err := strconv.ParseUint(port, 10, 16); err == nil {
+			u16Port = uint16(port)
+		}
+		conn, err := proxy.DialContext(ctx, &constant.Metadata{
+			Host:    host,
+			DstPort: u16Port,
+		})
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		return conn, nil
+	}
+}
+
+// dialQUIC 通过节点的 ListenPacketContext 建立 QUIC 连接，目标地址在本地解析
+func dialQUIC(ctx context.Context, proxy constant.Proxy, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	if !proxy.SupportUDP() {
+		return nil, fmt.Errorf("proxy %s does not support UDP", proxy.Name())
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no address found for %s", host)
+		}
+		ip = ips[0]
+	}
+	ip = ip.Unmap()
+
+	pc, err := proxy.ListenPacketContext(ctx, &constant.Metadata{
+		NetWork: constant.UDP,
+		Host:    host,
+		DstIP:   ip,
+		DstPort: uint16(portInt),
+	})
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "udp", Err: err}
+	}
+	transport := quic.Transport{Conn: pc}
+	transport.SetCreatedConn(true) // 连接关闭时同时关闭 pc
+	transport.SetSingleUse(true)
+	conn, err := transport.DialEarly(ctx, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(portInt))), tlsCfg, cfg)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
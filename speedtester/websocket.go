@@ -0,0 +1,121 @@
+package speedtester
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/metacubex/mihomo/constant"
+)
+
+// 吞吐量测试中每条消息的大小
+const webSocketMessageSize = 16 * 1024
+
+// webSocketURL WebSocket 测试地址，没有设置 WebSocketURL 时使用第一个测试目标的 /__ws，需要是自建的 download-server
+func (st *SpeedTester) webSocketURL() string {
+	if st.config.WebSocketURL != "" {
+		return st.config.WebSocketURL
+	}
+	target := st.targets()[0]
+	if target.Protocol == ProtocolGet {
+		return ""
+	}
+	base := target.baseURL()
+	if strings.HasPrefix(base, "https://") {
+		return "wss://" + strings.TrimPrefix(base, "https://") + "/__ws"
+	}
+	return "ws://" + strings.TrimPrefix(base, "http://") + "/__ws"
+}
+
+type webSocketResult struct {
+	upgradeTime time.Duration
+	latency     time.Duration
+	throughput  float64
+}
+
+// testWebSocket 通过节点连接 WebSocket echo 地址，测试握手时间、消息往返时间和持续发送消息的吞吐量
+func (st *SpeedTester) testWebSocket(proxy constant.Proxy, url string) (*webSocketResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), st.config.Timeout)
+	defer cancel()
+
+	dialer := ws.Dialer{NetDial: proxyDialContext(proxy)}
+	start := time.Now()
+	conn, br, _, err := dialer.Dial(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	result := &webSocketResult{upgradeTime: time.Since(start)}
+
+	// br 不为空时其中缓存了服务器在握手之后发送的数据
+	var rw io.ReadWriter = conn
+	if br != nil {
+		rw = struct {
+			io.Reader
+			io.Writer
+		}{br, conn}
+	}
+	// 1. 逐条发送小消息测试往返时间
+	conn.SetDeadline(time.Now().Add(st.config.Timeout))
+	message := make([]byte, 32)
+	var total time.Duration
+	for i := 0; i < st.config.LatencyCount; i++ {
+		start := time.Now()
+		if err := writeWebSocketMessage(conn, message); err != nil {
+			return result, err
+		}
+		if _, _, err := wsutil.ReadServerData(rw); err != nil {
+			return result, err
+		}
+		total += time.Since(start)
+	}
+	result.latency = total / time.Duration(st.config.LatencyCount)
+
+	// 2. 持续发送消息，按收到的 echo 计算吞吐量，超时前收到的数据同样计入
+	conn.SetDeadline(time.Now().Add(st.config.Timeout))
+	count := max(st.config.WebSocketSize/webSocketMessageSize, 1)
+	payload := make([]byte, webSocketMessageSize)
+	writeErr := make(chan error, 1)
+	start = time.Now()
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := writeWebSocketMessage(conn, payload); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+	var received int
+	for i := 0; i < count; i++ {
+		data, _, err := wsutil.ReadServerData(rw)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && received > 0 {
+				break
+			}
+			return result, err
+		}
+		received += len(data)
+	}
+	result.throughput = float64(received) / time.Since(start).Seconds()
+	if err := <-writeErr; err != nil && received == 0 {
+		return result, err
+	}
+	return result, nil
+}
+
+// writeWebSocketMessage 把整个帧合并成一次写入，避免帧头和数据分成两个 TCP 包影响往返时间
+func writeWebSocketMessage(conn net.Conn, payload []byte) error {
+	frame, err := ws.CompileFrame(ws.MaskFrame(ws.NewBinaryFrame(payload)))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(frame)
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/faceair/clash-speedtest/speedtester"
+	"github.com/metacubex/mihomo/log"
+	"github.com/olekukonko/tablewriter"
+	"github.com/schollz/progressbar/v3"
+)
+
+// runStability 在 -stability 时间内持续测试所有节点，按在线率排序输出结果
+func runStability(speedTester *speedtester.SpeedTester, proxies map[string]*speedtester.CProxy) {
+	// 限制同时测试的节点数时节点分批测试，总时间为批数乘以 -stability
+	total := speedTester.StabilityDuration(len(proxies), *stability)
+	fmt.Printf("stability test for %d nodes, it will take %s\n", len(proxies), total)
+
+	bar := progressbar.Default(int64(total.Seconds()), "稳定性测试中...")
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				bar.Add(1)
+			}
+		}
+	}()
+
+	results := make([]*speedtester.StabilityResult, 0, len(proxies))
+	speedTester.TestStability(proxies, *stability, func(result *speedtester.StabilityResult) {
+		results = append(results, result)
+	})
+	close(done)
+	bar.Finish()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Uptime != results[j].Uptime {
+			return results[i].Uptime > results[j].Uptime
+		}
+		return results[i].Latency < results[j].Latency
+	})
+	printStabilityResults(results)
+
+	if *jsonReportPath != "" {
+		if err := writeJSONReport(results); err != nil {
+			log.Fatalln("write json report failed: %v", err)
+		}
+		fmt.Printf("\nsave json report to: %s\n", *jsonReportPath)
+	}
+}
+
+func printStabilityResults(results []*speedtester.StabilityResult) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{
+		"序号",
+		"节点名称",
+		"类型",
+		"在线率",
+		"最长中断",
+		"重连次数",
+		"平均延迟",
+		"延迟标准差",
+		"下载速度",
+	})
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetTablePadding("\t")
+	table.SetNoWhiteSpace(true)
+
+	for i, result := range results {
+		uptimeStr := result.FormatUptime()
+		if result.Uptime >= 99 {
+			uptimeStr = colorGreen + uptimeStr + colorReset
+		} else if result.Uptime >= 95 {
+			uptimeStr = colorYellow + uptimeStr + colorReset
+		} else {
+			uptimeStr = colorRed + uptimeStr + colorReset
+		}
+
+		var stdDev time.Duration
+		if result.LatencyStats != nil {
+			stdDev = result.LatencyStats.StdDev
+		}
+		downloadSpeedStr := "N/A"
+		if result.DownloadSpeed > 0 {
+			downloadSpeedStr = formatBytes(int64(result.DownloadSpeed)) + "/s"
+		}
+
+		table.Append([]string{
+			fmt.Sprintf("%d.", i+1),
+			result.ProxyName,
+			result.ProxyType,
+			uptimeStr,
+			result.LongestOutage.Round(time.Second).String(),
+			fmt.Sprint(result.Reconnects),
+			formatLatency(result.Latency),
+			formatLatency(stdDev),
+			downloadSpeedStr,
+		})
+	}
+
+	fmt.Println()
+	table.Render()
+}
+
+// writeJSONReport 把完整的测试结果写入 -json-report 指定的文件
+func writeJSONReport(report any) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*jsonReportPath, data, 0o644)
+}